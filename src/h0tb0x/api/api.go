@@ -1,24 +1,29 @@
 package api
 
 import (
+	"crypto/tls"
 	"encoding/json"
-	"fmt"
 	"github.com/gorilla/mux"
 	"h0tb0x/base"
 	"h0tb0x/conn"
 	"h0tb0x/crypto"
 	"h0tb0x/data"
+	"h0tb0x/meta"
 	"h0tb0x/rendezvous"
 	"h0tb0x/sync"
 	"h0tb0x/transfer"
+	"mime"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	gosync "sync"
+	"time"
 )
 
 type ApiMgr struct {
 	*data.DataMgr
+	TlsCert  *tls.Certificate // If set before Start, the API is served over https with it
 	extHost  string
 	extPort  uint16
 	rshost   string
@@ -30,6 +35,15 @@ type ApiMgr struct {
 	listener net.Listener
 	mutex    gosync.Locker
 	connMgr  conn.ConnMgr
+	// Wakes up change feeds, has its own lock since it's signaled from the meta-data layer
+	changeLock gosync.Mutex
+	changed    gosync.Cond
+	changeGen  int  // Bumped on every change
+	closing    bool // Set on Stop, so change feeds end
+	// Clients of the event stream
+	eventLock    gosync.Mutex
+	eventClients map[chan *EventJson]bool
+	eventsClosed bool
 }
 
 type SelfJson struct {
@@ -50,18 +64,88 @@ type FriendJson struct {
 }
 
 type CollectionJson struct {
-	Id    string `json:"id"`
-	Owner string `json:"owner"`
+	Id          string `json:"id"`
+	Owner       string `json:"owner"`
+	Private     bool   `json:"private"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	IconKey     string `json:"iconKey,omitempty"` // The key of the icon's data
+	Icon        string `json:"icon,omitempty"`    // The icon's digest, the ETag of its data
+	Created     string `json:"created,omitempty"`
 }
 
 type CollectionItemJson struct {
-	Key string `json:"key"`
+	Key         string            `json:"key"`
+	Size        int64             `json:"size"`
+	ContentType string            `json:"contentType,omitempty"`
+	ModTime     string            `json:"modTime,omitempty"`
+	Author      string            `json:"author"`
+	Attrs       map[string]string `json:"attrs"`
+	Prefix      bool              `json:"prefix,omitempty"` // A common prefix of keys, from a delimited listing
 }
 
+// A page of a listing of collection data, next is the cursor for the page after, if any
+type ListJson struct {
+	Items []CollectionItemJson `json:"items"`
+	Next  string               `json:"next,omitempty"`
+}
+
+// Headers with this prefix set attributes of data that's put
+const attrHeader = "X-Attr-"
+
 type InviteJson struct {
-	Cid    string `json:"cid"`
-	Friend string `json:"friend"`
-	Remove bool   `json:",omitempty"`
+	Cid      string `json:"cid"`
+	Friend   string `json:"friend"`
+	Remove   bool   `json:",omitempty"`
+	Role     string `json:"role,omitempty"`  // reader or writer
+	State    string `json:"state,omitempty"` // pending, accepted or rejected
+	Outgoing bool   `json:"outgoing"`        // Sent by me
+	Created  string `json:"created,omitempty"`
+	Action   string `json:"action,omitempty"` // accept or reject, when posting an answer
+}
+
+// The names of invite roles and states, as used by InviteJson
+var roleNames = map[int]string{
+	meta.RoleReader: "reader",
+	meta.RoleWriter: "writer",
+}
+
+var inviteStateNames = map[int]string{
+	meta.InvitePending:  "pending",
+	meta.InviteAccepted: "accepted",
+	meta.InviteRejected: "rejected",
+}
+
+type StorageJson struct {
+	Quota        int64 `json:"quota"`
+	Used         int64 `json:"used"`
+	Kept         int64 `json:"kept"`
+	Blobs        int   `json:"blobs"`
+	Evictions    int   `json:"evictions"`
+	EvictedBytes int64 `json:"evictedBytes"`
+}
+
+type PinJson struct {
+	Key    string `json:"key"`
+	Policy string `json:"policy"`
+}
+
+type RenameJson struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Recursive bool   `json:"recursive"` // Rename every key starting with From
+}
+
+// How many keys a recursive operation changed
+type CountJson struct {
+	Count int `json:"count"`
+}
+
+// The names of download policies, as used by PinJson
+var policyNames = map[int]string{
+	data.PolicyEager:    "eager",
+	data.PolicyOnDemand: "on-demand",
+	data.PolicyNever:    "never",
 }
 
 type WriterJson struct {
@@ -69,76 +153,142 @@ type WriterJson struct {
 	PubKey string `json:"pubkey"`
 }
 
-func NewApiMgr(rshost string, apiPort uint16, data *data.DataMgr, connMgr conn.ConnMgr) *ApiMgr {
+// Makes the API, listening on apiHost, every call but login needs a token from CreateToken
+func NewApiMgr(rshost string, apiHost string, apiPort uint16, data *data.DataMgr, connMgr conn.ConnMgr) *ApiMgr {
 	router := mux.NewRouter()
 	server := &http.Server{
 		Handler: router,
-		Addr:    fmt.Sprintf(":%d", apiPort),
+		Addr:    net.JoinHostPort(apiHost, strconv.Itoa(int(apiPort))),
 	}
 
 	api := &ApiMgr{
-		rshost:  rshost,
-		rclient: rendezvous.NewClient(connMgr),
-		DataMgr: data,
-		router:  router,
-		server:  server,
-		port:    apiPort,
-		connMgr: connMgr,
-		mutex:   base.NewNoisyLocker(data.Log.Prefix() + "api "),
+		rshost:       rshost,
+		rclient:      rendezvous.NewClient(connMgr),
+		DataMgr:      data,
+		router:       router,
+		server:       server,
+		port:         apiPort,
+		connMgr:      connMgr,
+		mutex:        base.NewNoisyLocker(data.Log.Prefix() + "api "),
+		eventClients: make(map[chan *EventJson]bool),
 	}
 
+	api.changed.L = &api.changeLock
+	data.AddCallback(api.onChange)
+	data.AddListener(api.onFriendEvent)
+	data.AddSubscribeListener(api.onSubscribeEvent)
+	data.AddDownloadListener(api.onDownloadEvent)
+
 	sr := router.PathPrefix("/api").Subrouter()
+	// Every call is checked against the token's scope, and only data calls take
+	// collection tokens
+	handle := func(path string, handler http.HandlerFunc) *mux.Route {
+		return sr.HandleFunc(path, api.authorize(handler, routeApi))
+	}
+	handleData := func(path string, handler http.HandlerFunc) *mux.Route {
+		return sr.HandleFunc(path, api.authorize(handler, routeData))
+	}
+
+	// log in with a token, setting a cookie for the web app, and log out
+	sr.HandleFunc("/login", api.postLogin).Methods("POST")
+	sr.HandleFunc("/login", api.deleteLogin).Methods("DELETE")
 
 	// get self details
-	sr.HandleFunc("/self", api.getSelf).Methods("GET")
+	handle("/self", api.getSelf).Methods("GET")
+
+	// get storage usage
+	handle("/storage", api.getStorage).Methods("GET")
+
+	// stream events over a websocket
+	sr.HandleFunc("/events", api.authorize(api.getEvents, routeEvents)).Methods("GET")
 
 	// Friends
 	// list friends
-	sr.HandleFunc("/friends", api.getFriends).Methods("GET")
+	handle("/friends", api.getFriends).Methods("GET")
 	// add friend
-	sr.HandleFunc("/friends", api.postFriends).Methods("POST")
+	handle("/friends", api.postFriends).Methods("POST")
 	// get friend details
-	sr.HandleFunc("/friends/{who}", api.getFriend).Methods("GET")
+	handle("/friends/{who}", api.getFriend).Methods("GET")
 	// remove friend
-	sr.HandleFunc("/friends/{who}", api.deleteFriend).Methods("DELETE")
+	handle("/friends/{who}", api.deleteFriend).Methods("DELETE")
 
 	// handle invitations
-	// list incoming invitation
-	sr.HandleFunc("/invites", api.getInvites).Methods("GET")
+	// list invitations, sent and received
+	handle("/invites", api.getInvites).Methods("GET")
 	// accept/reject invitation
-	sr.HandleFunc("/invites", api.postInvite).Methods("POST")
+	handle("/invites", api.postInvite).Methods("POST")
 	// send invitation
-	sr.HandleFunc("/friends/{who}/invites", api.postFriendInvite).Methods("POST")
+	handle("/friends/{who}/invites", api.postFriendInvite).Methods("POST")
 
 	// Collections
 	// list collections
-	sr.HandleFunc("/collections", api.getCollections).Methods("GET")
+	handle("/collections", api.getCollections).Methods("GET")
 	// create collection
-	sr.HandleFunc("/collections", api.addCollection).Methods("POST")
+	handle("/collections", api.addCollection).Methods("POST")
 	// get collection details
-	sr.HandleFunc("/collections/{cid}", api.getCollection).Methods("GET")
+	handle("/collections/{cid}", api.getCollection).Methods("GET")
+	// set the name, description and icon of a collection
+	handle("/collections/{cid}", api.putCollection).Methods("PUT")
+	// close collection
+	handle("/collections/{cid}", api.deleteCollection).Methods("DELETE")
 
 	// Collections Writers
 	// list collection writers
-	sr.HandleFunc("/collections/{cid}/writers", api.getWriters).Methods("GET")
+	handle("/collections/{cid}/writers", api.getWriters).Methods("GET")
 	// get collection writer details
-	sr.HandleFunc("/collections/{cid}/writers/{who}", api.getWriter).Methods("GET")
+	handle("/collections/{cid}/writers/{who}", api.getWriter).Methods("GET")
 	// add collection writer
-	sr.HandleFunc("/collections/{cid}/writers", api.addWriter).Methods("POST")
+	handle("/collections/{cid}/writers", api.addWriter).Methods("POST")
 	// remove collection writer
-	sr.HandleFunc("/collections/{cid}/writers/{who}", api.deleteWriter).Methods("DELETE")
+	handle("/collections/{cid}/writers/{who}", api.deleteWriter).Methods("DELETE")
+
+	// Collections Readers
+	// list collection readers
+	handle("/collections/{cid}/readers", api.getReaders).Methods("GET")
+	// add collection reader
+	handle("/collections/{cid}/readers", api.addReader).Methods("POST")
+	// remove collection reader
+	handle("/collections/{cid}/readers/{who}", api.deleteReader).Methods("DELETE")
+
+	// Collections Pins
+	// list download policies
+	handle("/collections/{cid}/pins", api.getPins).Methods("GET")
+	// set a download policy
+	handle("/collections/{cid}/pins", api.addPin).Methods("POST")
+	// remove the collection download policy
+	handle("/collections/{cid}/pins", api.deletePin).Methods("DELETE")
+	// remove the download policy of a key
+	handle("/collections/{cid}/pins/{key:.+}", api.deletePin).Methods("DELETE")
 
 	// Collection Objects
 	// list collection objects
-	sr.HandleFunc("/collections/{cid}/data", api.listData).Methods("GET")
+	handleData("/collections/{cid}/data", api.listData).Methods("GET")
+	// wait for changes to collection objects
+	handleData("/collections/{cid}/changes", api.getChanges).Methods("GET")
+	// Delete every key starting with ?prefix=
+	handleData("/collections/{cid}/data", api.deletePrefix).Methods("DELETE")
+	// Rename a key, or every key starting with a prefix
+	handleData("/collections/{cid}/rename", api.renameData).Methods("POST")
+	// Get how many previous versions of each key are kept
+	handle("/collections/{cid}/retention", api.getRetention).Methods("GET")
+	// Set how many previous versions of each key are kept
+	handle("/collections/{cid}/retention", api.putRetention).Methods("PUT")
+	// Make a previous version of a key current again
+	handleData("/collections/{cid}/restore", api.restoreData).Methods("POST")
+	// list keys written by more than one writer at once
+	handleData("/collections/{cid}/conflicts", api.getConflicts).Methods("GET")
+	// get the values of a conflicting key
+	handleData("/collections/{cid}/conflicts/{key:.+}", api.getConflict).Methods("GET")
+	// resolve a conflict by putting the merged data
+	handleData("/collections/{cid}/conflicts/{key:.+}", api.resolveConflict).Methods("PUT")
 	// get collection object
-	sr.HandleFunc("/collections/{cid}/data/{key:.+}", api.getData).Methods("GET")
+	handleData("/collections/{cid}/data/{key:.+}", api.getData).Methods("GET")
 	// update collection object
-	sr.HandleFunc("/collections/{cid}/data/{key:.+}", api.putData).Methods("PUT")
+	handleData("/collections/{cid}/data/{key:.+}", api.putData).Methods("PUT")
 	// add new collection object
-	sr.HandleFunc("/collections/{cid}/data/{key:.+}", api.postData).Methods("POST")
+	handleData("/collections/{cid}/data/{key:.+}", api.postData).Methods("POST")
 	// remove collection objects
-	sr.HandleFunc("/collections/{cid}/data/{key:.+}", api.deleteData).Methods("DELETE")
+	handleData("/collections/{cid}/data/{key:.+}", api.deleteData).Methods("DELETE")
 
 	// serve web app
 	router.PathPrefix("/").Handler(http.FileServer(http.Dir("web/app")))
@@ -157,12 +307,22 @@ func (this *ApiMgr) Start() error {
 	if err != nil {
 		return err
 	}
+	if this.TlsCert != nil {
+		this.listener = tls.NewListener(this.listener, &tls.Config{
+			Certificates: []tls.Certificate{*this.TlsCert},
+		})
+	}
 	this.wait.Add(1)
 	go this.runServer()
 	return nil
 }
 
 func (this *ApiMgr) Stop() {
+	this.changeLock.Lock()
+	this.closing = true
+	this.changed.Broadcast()
+	this.changeLock.Unlock()
+	this.closeEvents()
 	this.listener.Close()
 	this.wait.Wait()
 	this.DataMgr.Stop()
@@ -235,6 +395,18 @@ func (this *ApiMgr) getSelf(w http.ResponseWriter, req *http.Request) {
 	this.sendJson(w, json)
 }
 
+func (this *ApiMgr) getStorage(w http.ResponseWriter, req *http.Request) {
+	stats := this.Storage()
+	this.sendJson(w, StorageJson{
+		Quota:        stats.Quota,
+		Used:         stats.Used,
+		Kept:         stats.Kept,
+		Blobs:        stats.Blobs,
+		Evictions:    stats.Evictions,
+		EvictedBytes: stats.EvictedBytes,
+	})
+}
+
 func (this *ApiMgr) populateFriend(json *FriendJson, myFp, fp *crypto.Digest, keyBin []byte) {
 	json.Id = fp.String()
 	if keyBin != nil {
@@ -350,11 +522,10 @@ func (this *ApiMgr) doPutFriend(w http.ResponseWriter, req *http.Request, json *
 		this.UpdateHostData(fp, json.Host, json.Port)
 	}
 
-	// If public key exists, add it
-	// TODO: Actually write AddPublicKey and enable code
-	//if (pubkey != nil) {
-	//	this.AddPublicKey(fp, pubkey)
-	//}
+	// If public key exists, add it, it was checked against the fingerprint above
+	if pubkey != nil {
+		this.AddPublicKey(fp, pubkey)
+	}
 
 	json.Id = fp.String()
 	json.Rendezvous = rendezvous
@@ -364,8 +535,11 @@ func (this *ApiMgr) doPutFriend(w http.ResponseWriter, req *http.Request, json *
 		RecvCid:  "",
 	}
 	myFp := this.Ident.Public().Fingerprint()
-	// FIXME: how do we get pubkey to be passed in to populateFriend()?
-	this.populateFriend(result, myFp, fp, nil)
+	var keyBin []byte
+	if key := this.GetPublicKey(fp); key != nil {
+		keyBin = transfer.AsBytes(key)
+	}
+	this.populateFriend(result, myFp, fp, keyBin)
 	return result
 }
 
@@ -387,11 +561,10 @@ func (this *ApiMgr) getCollections(w http.ResponseWriter, req *http.Request) {
 	for rows.Next() {
 		var topic string
 		this.Db.Scan(rows, &topic)
-		json := CollectionJson{
-			Id:    topic,
-			Owner: this.GetOwner(topic).Fingerprint().String(),
+		if this.IsClosed(topic) {
+			continue
 		}
-		out = append(out, json)
+		out = append(out, this.collectionJson(topic, this.GetOwner(topic)))
 	}
 	this.sendJson(w, out)
 }
@@ -400,24 +573,106 @@ func (this *ApiMgr) getCollection(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	cid := vars["cid"]
 	owner := this.GetOwner(cid)
-	if owner == nil {
+	if owner == nil || this.IsClosed(cid) {
 		this.sendError(w, http.StatusNotFound, "No such collection")
 		return
 	}
-	json := &CollectionJson{
-		Id:    cid,
-		Owner: owner.Fingerprint().String(),
+	this.sendJson(w, this.collectionJson(cid, owner))
+}
+
+// Describes a collection, with its info if it has any
+func (this *ApiMgr) collectionJson(cid string, owner *crypto.PublicIdentity) CollectionJson {
+	json := CollectionJson{
+		Id:      cid,
+		Owner:   owner.Fingerprint().String(),
+		Private: this.IsPrivate(cid),
 	}
-	this.sendJson(w, json)
+	if info := this.GetInfo(cid); info != nil {
+		json.Name = info.Name
+		json.Description = info.Description
+		json.IconKey = info.IconKey
+		json.Icon = info.IconDigest
+		json.Created = time.Unix(info.Created, 0).UTC().Format(time.RFC3339)
+	}
+	return json
+}
+
+// Sets the name, description and icon of a collection from a collection object
+func (this *ApiMgr) setInfo(cid string, body *CollectionJson) error {
+	info := &meta.CollectionInfo{
+		Name:        body.Name,
+		Description: body.Description,
+		IconKey:     body.IconKey,
+	}
+	if body.IconKey != "" {
+		digest, err := this.GetDigest(cid, body.IconKey)
+		if err != nil {
+			return err
+		}
+		info.IconDigest = digest
+	}
+	return this.SetInfo(cid, this.Ident, info)
+}
+
+func (this *ApiMgr) putCollection(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	cid := vars["cid"]
+	owner := this.GetOwner(cid)
+	if owner == nil || this.IsClosed(cid) {
+		this.sendError(w, http.StatusNotFound, "No such collection")
+		return
+	}
+	if owner.Fingerprint().String() != this.Ident.Fingerprint().String() {
+		this.sendError(w, http.StatusUnauthorized, "You are not the owner of this collection")
+		return
+	}
+	var body CollectionJson
+	if !this.decodeJsonBody(w, req, &body) {
+		return
+	}
+	err := this.setInfo(cid, &body)
+	if err != nil {
+		this.sendError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	this.sendJson(w, this.collectionJson(cid, owner))
 }
 
 func (this *ApiMgr) addCollection(w http.ResponseWriter, req *http.Request) {
-	cid := this.CreateNewCollection(this.Ident)
-	json := &CollectionJson{
-		Id:    cid,
-		Owner: this.GetOwner(cid).Fingerprint().String(),
+	// The body is optional, anything other than a collection object makes a public collection
+	var body CollectionJson
+	_ = json.NewDecoder(req.Body).Decode(&body)
+	var cid string
+	if body.Private {
+		cid = this.CreatePrivateCollection(this.Ident)
+	} else {
+		cid = this.CreateNewCollection(this.Ident)
+	}
+	// A new collection has no data for an icon yet
+	body.IconKey = ""
+	if body.Name != "" || body.Description != "" {
+		err := this.setInfo(cid, &body)
+		if err != nil {
+			this.sendError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	this.sendJson(w, this.collectionJson(cid, this.GetOwner(cid)))
+}
+
+func (this *ApiMgr) deleteCollection(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	cid := vars["cid"]
+	owner := this.GetOwner(cid)
+	if owner == nil || this.IsClosed(cid) {
+		this.sendError(w, http.StatusNotFound, "No such collection")
+		return
+	}
+	err := this.CloseCollection(cid, this.Ident)
+	if err != nil {
+		this.sendError(w, http.StatusUnauthorized, err.Error())
+		return
 	}
-	this.sendJson(w, json)
 }
 
 func (this *ApiMgr) getWriters(w http.ResponseWriter, req *http.Request) {
@@ -428,17 +683,12 @@ func (this *ApiMgr) getWriters(w http.ResponseWriter, req *http.Request) {
 		this.sendError(w, http.StatusNotFound, "No such collection")
 		return
 	}
-	rows := this.Db.MultiQuery("SELECT key, value FROM Object WHERE topic = ? AND type = ?",
-		cid, sync.RTWriter)
 	out := []WriterJson{}
-	for rows.Next() {
-		var json WriterJson
-		var data []byte
-		this.Db.Scan(rows, &json.Id, &data)
-		if len(data) > 0 {
-			json.PubKey = transfer.AsString(data)
-			out = append(out, json)
-		}
+	for _, writer := range this.ListWriters(cid) {
+		out = append(out, WriterJson{
+			Id:     writer.Fingerprint().String(),
+			PubKey: transfer.AsString(writer),
+		})
 	}
 	this.sendJson(w, out)
 }
@@ -502,7 +752,107 @@ func (this *ApiMgr) deleteWriter(w http.ResponseWriter, req *http.Request) {
 	this.RemoveWriter(cid, this.Ident, who)
 }
 
+func (this *ApiMgr) getReaders(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	cid := vars["cid"]
+	if !this.IsPrivate(cid) {
+		this.sendError(w, http.StatusNotFound, "No such private collection")
+		return
+	}
+	out := []WriterJson{}
+	for _, reader := range this.GetReaders(cid) {
+		out = append(out, WriterJson{
+			Id:     reader.Fingerprint().String(),
+			PubKey: transfer.AsString(reader),
+		})
+	}
+	this.sendJson(w, out)
+}
+
+func (this *ApiMgr) addReader(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	cid := vars["cid"]
+	var keystr string
+	if !this.decodeJsonBody(w, req, &keystr) {
+		return
+	}
+	var pubkey *crypto.PublicIdentity
+	err := transfer.DecodeString(keystr, &pubkey)
+	if err != nil {
+		this.sendError(w, http.StatusBadRequest, "Invalid public key")
+		return
+	}
+	err = this.AddReader(cid, this.Ident, pubkey)
+	if err != nil {
+		this.sendError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	this.sendJson(w, "/collections/"+cid+"/readers/"+pubkey.Fingerprint().String())
+}
+
+func (this *ApiMgr) deleteReader(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	cid := vars["cid"]
+	who := vars["who"]
+	err := this.RemoveReader(cid, this.Ident, who)
+	if err != nil {
+		this.sendError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+}
+
+func (this *ApiMgr) getPins(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	cid := vars["cid"]
+	if this.GetOwner(cid) == nil || this.IsClosed(cid) {
+		this.sendError(w, http.StatusNotFound, "No such collection")
+		return
+	}
+	out := []PinJson{}
+	for _, pin := range this.GetPins(cid) {
+		out = append(out, PinJson{Key: pin.Key, Policy: policyNames[pin.Policy]})
+	}
+	this.sendJson(w, out)
+}
+
+func (this *ApiMgr) addPin(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	cid := vars["cid"]
+	if this.GetOwner(cid) == nil || this.IsClosed(cid) {
+		this.sendError(w, http.StatusNotFound, "No such collection")
+		return
+	}
+	var pin PinJson
+	if !this.decodeJsonBody(w, req, &pin) {
+		return
+	}
+	for policy, name := range policyNames {
+		if name == pin.Policy {
+			this.SetPolicy(cid, pin.Key, policy)
+			return
+		}
+	}
+	this.sendError(w, http.StatusBadRequest, "Invalid policy")
+}
+
+func (this *ApiMgr) deletePin(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	this.ClearPolicy(vars["cid"], vars["key"])
+}
+
 func (this *ApiMgr) getInvites(w http.ResponseWriter, req *http.Request) {
+	out := []InviteJson{}
+	for _, invite := range this.GetInvites() {
+		out = append(out, InviteJson{
+			Cid:      invite.Cid,
+			Friend:   invite.Friend.String(),
+			Role:     roleNames[invite.Role],
+			State:    inviteStateNames[invite.State],
+			Outgoing: invite.Outgoing,
+			Created:  invite.Created.UTC().Format(time.RFC3339),
+		})
+	}
+	this.sendJson(w, out)
 }
 
 func (this *ApiMgr) postInvite(w http.ResponseWriter, req *http.Request) {
@@ -518,6 +868,24 @@ func (this *ApiMgr) postInvite(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	this.Log.Printf("Processing an invite %s:%s:%v", invite.Cid, invite.Friend, invite.Remove)
+	if invite.Action != "" {
+		if invite.Action != "accept" && invite.Action != "reject" {
+			this.sendError(w, http.StatusBadRequest, "Invalid action")
+			return
+		}
+		err = this.AnswerInvite(fp, invite.Cid, invite.Action == "accept")
+		if err != nil {
+			this.sendError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		this.sendJson(w, "OK")
+		return
+	}
+	// Without an action, just subscribe or unsubscribe
+	if !invite.Remove && this.IsClosed(invite.Cid) {
+		this.sendError(w, http.StatusBadRequest, "Collection is closed")
+		return
+	}
 	if !this.Subscribe(fp, invite.Cid, !invite.Remove) {
 		this.sendError(w, http.StatusBadRequest, "Invalid friend Id")
 		return
@@ -526,6 +894,30 @@ func (this *ApiMgr) postInvite(w http.ResponseWriter, req *http.Request) {
 }
 
 func (this *ApiMgr) postFriendInvite(w http.ResponseWriter, req *http.Request) {
+	fp := this.decodeWho(req)
+	if fp == nil {
+		this.sendError(w, http.StatusBadRequest, "Invalid friend id")
+		return
+	}
+	var invite InviteJson
+	if !this.decodeJsonBody(w, req, &invite) {
+		return
+	}
+	role := -1
+	for r, name := range roleNames {
+		if name == invite.Role {
+			role = r
+		}
+	}
+	if invite.Role == "" {
+		role = meta.RoleReader
+	}
+	err := this.SendInvite(fp, invite.Cid, role)
+	if err != nil {
+		this.sendError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	this.sendJson(w, "OK")
 }
 
 func (this *ApiMgr) getData(w http.ResponseWriter, req *http.Request) {
@@ -537,13 +929,95 @@ func (this *ApiMgr) getData(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	key := vars["key"]
-	err := this.GetData(cid, key, w)
+	query := req.URL.Query()
+	if _, ok := query["history"]; ok {
+		this.getHistory(w, cid, key)
+		return
+	}
+	if query.Get("version") != "" {
+		this.getVersionData(w, req, cid, key)
+		return
+	}
+	if query.Get("author") != "" {
+		this.getSiblingData(w, req, cid, key)
+		return
+	}
+	rec, err := this.GetRecord(cid, key)
+	if err != nil {
+		this.sendError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	// Blobs never change, so the digest is all a cache needs
+	etag := `"` + rec.Digest.String() + `"`
+	w.Header().Set("ETag", etag)
+	setDataHeaders(w, rec)
+	if matchesETag(req.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	// Local data of public collections supports ranges, anything else is streamed
+	file, err := this.OpenData(cid, key)
+	if err == nil {
+		http.ServeContent(w, req, "", time.Time{}, file)
+		file.Close()
+		return
+	}
+	wait := time.Duration(0)
+	if str := req.URL.Query().Get("wait"); str != "" {
+		secs, err := strconv.Atoi(str)
+		if err != nil || secs < 0 {
+			this.sendError(w, http.StatusBadRequest, "Invalid wait")
+			return
+		}
+		wait = time.Duration(secs) * time.Second
+	}
+	err = this.GetDataWait(cid, key, w, wait)
 	// TODO: Handle each error independently
 	if err != nil {
 		this.sendError(w, http.StatusBadRequest, err.Error())
 	}
 }
 
+// Content types data is served inline as, since none of them run script
+var inlineTypes = map[string]bool{
+	"text/plain":       true,
+	"application/json": true,
+	"image/png":        true,
+	"image/jpeg":       true,
+	"image/gif":        true,
+	"image/webp":       true,
+	"audio/mpeg":       true,
+	"audio/ogg":        true,
+	"video/mp4":        true,
+	"video/webm":       true,
+}
+
+// Sets the headers of data.  Any writer picks its content type, and it's served from the
+// same origin as the API, so it's never sniffed or run, and anything which might run, like
+// html, is sent as an attachment.
+func setDataHeaders(w http.ResponseWriter, rec *data.DataRecord) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	mediaType, _, err := mime.ParseMediaType(rec.ContentType)
+	if err == nil && inlineTypes[mediaType] {
+		w.Header().Set("Content-Type", rec.ContentType)
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", "attachment")
+	}
+}
+
+// Checks an If-None-Match header against an ETag
+func matchesETag(header string, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
 func (this *ApiMgr) putData(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	cid := vars["cid"]
@@ -558,12 +1032,26 @@ func (this *ApiMgr) putData(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	key := vars["key"]
-	err := this.PutData(cid, key, this.Ident, req.Body)
+	err := this.PutDataRecord(cid, key, this.Ident, req.Body, headerRecord(req))
 	if err != nil {
 		this.sendError(w, http.StatusBadRequest, err.Error())
 	}
 }
 
+// Makes the record of data that's put, from its Content-Type and X-Attr-{name} headers
+func headerRecord(req *http.Request) *data.DataRecord {
+	rec := &data.DataRecord{
+		ContentType: req.Header.Get("Content-Type"),
+		Attrs:       map[string]string{},
+	}
+	for name, values := range req.Header {
+		if strings.HasPrefix(name, attrHeader) && len(values) > 0 {
+			rec.Attrs[strings.ToLower(name[len(attrHeader):])] = values[0]
+		}
+	}
+	return rec
+}
+
 func (this *ApiMgr) postData(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	cid := vars["cid"]
@@ -606,8 +1094,18 @@ func (this *ApiMgr) postData(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
+		// The other fields of the form are attributes
+		rec := &data.DataRecord{
+			ContentType: fh[0].Header.Get("Content-Type"),
+			Attrs:       map[string]string{},
+		}
+		for name, values := range req.MultipartForm.Value {
+			if len(values) > 0 {
+				rec.Attrs[name] = values[0]
+			}
+		}
 		key := vars["key"]
-		err = this.PutData(cid, key, this.Ident, file)
+		err = this.PutDataRecord(cid, key, this.Ident, file, rec)
 		if err != nil {
 			this.sendError(w, http.StatusBadRequest, err.Error())
 		}
@@ -616,24 +1114,40 @@ func (this *ApiMgr) postData(w http.ResponseWriter, req *http.Request) {
 }
 
 func (this *ApiMgr) deleteData(w http.ResponseWriter, req *http.Request) {
-	this.sendError(w, http.StatusNotImplemented, "Not Implemented")
-}
-
-// TODO: Lot of options, limt 1000, starting key, time order, long poll, etc
-func (this *ApiMgr) listData(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	cid := vars["cid"]
-	rows := this.Db.MultiQuery(`
-		SELECT key FROM Object
-		WHERE type = ? AND topic = ?
-		GROUP BY key
-		ORDER BY key`,
-		sync.RTData, cid)
-	out := []CollectionItemJson{}
-	for rows.Next() {
-		var item CollectionItemJson
-		this.Db.Scan(rows, &item.Key)
-		out = append(out, item)
+	owner := this.GetOwner(cid)
+	if owner == nil {
+		this.sendError(w, http.StatusNotFound, "Collection invalid")
+		return
 	}
-	this.sendJson(w, out)
+	writer := this.GetWriter(cid, this.Ident.Public().Fingerprint().String())
+	if writer == nil {
+		this.sendError(w, http.StatusUnauthorized, "You are not a writer for this collection")
+		return
+	}
+	key := vars["key"]
+	err := this.Delete(cid, this.Ident, key)
+	if err != nil {
+		this.sendError(w, http.StatusNotFound, err.Error())
+	}
+}
+
+// Describes the current value of a key, false if it's deleted or unreadable
+func (this *ApiMgr) collectionItem(cid string, key string) (CollectionItemJson, bool) {
+	rec, err := this.GetRecord(cid, key)
+	if err != nil {
+		return CollectionItemJson{Key: key}, false
+	}
+	item := CollectionItemJson{
+		Key:         key,
+		Size:        rec.Size,
+		ContentType: rec.ContentType,
+		Author:      this.GetDataAuthor(cid, key),
+		Attrs:       rec.Attrs,
+	}
+	if rec.ModTime != 0 {
+		item.ModTime = time.Unix(rec.ModTime, 0).UTC().Format(time.RFC3339)
+	}
+	return item, true
 }
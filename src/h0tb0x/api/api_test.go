@@ -1,9 +1,12 @@
 package api
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"github.com/gorilla/websocket"
 	"h0tb0x/base"
 	"h0tb0x/conn"
 	"h0tb0x/data"
@@ -12,9 +15,12 @@ import (
 	"h0tb0x/rendezvous"
 	"h0tb0x/sync"
 	"h0tb0x/test"
+	"io/ioutil"
 	. "launchpad.net/gocheck"
 	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"strings"
 	"testing"
 	"time"
 )
@@ -49,23 +55,40 @@ type node struct {
 	api     *ApiMgr
 	tm      *test.TestMgr
 	baseUrl string
+	token   string
 }
 
 func (this *TestApiSuite) NewTestNode(name string, linkPort uint16, apiPort uint16) *node {
+	return this.newNode(name, linkPort, apiPort, false)
+}
+
+// Makes a node, which serves https with its identity if useTls is set
+func (this *TestApiSuite) newNode(name string, linkPort uint16, apiPort uint16, useTls bool) *node {
 	base := this.NewBase(name, linkPort)
 	link := link.NewLinkMgr(base, this.ConnMgr)
 	sync := sync.NewSyncMgr(link)
 	meta := meta.NewMetaMgr(sync)
 	data := data.NewDataMgr(this.GetTempDir(), meta)
-	api := NewApiMgr("localhost:3030", apiPort, data, this.ConnMgr)
+	api := NewApiMgr("localhost:3030", "localhost", apiPort, data, this.ConnMgr)
 	api.SetExt(net.IPv4(127, 0, 0, 1), linkPort)
+	client := conn.NewHttpClient(this.ConnMgr)
+	scheme := "http"
+	if useTls {
+		api.TlsCert = base.Ident.TlsCertificate()
+		// The key is checked by fingerprint instead
+		client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		scheme = "https"
+	}
 	api.Start()
+	token, err := CreateToken(base.Db, "test", ScopeAdmin, "")
+	this.C.Assert(err, IsNil)
 	return &node{
 		Base:    base,
 		c:       this.C,
-		client:  conn.NewHttpClient(this.ConnMgr),
+		client:  client,
 		api:     api,
-		baseUrl: fmt.Sprintf("http://localhost:%d", apiPort),
+		baseUrl: fmt.Sprintf("%s://localhost:%d", scheme, apiPort),
+		token:   token,
 	}
 }
 
@@ -73,8 +96,15 @@ func (this *node) Stop() {
 	this.api.Stop()
 }
 
+// Sends a request with the node's token
+func (this *node) do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Authorization", "Bearer "+this.token)
+	return this.client.Do(req)
+}
+
 func (this *node) get(url string, result interface{}) *http.Response {
-	resp, err := this.client.Get(this.baseUrl + url)
+	req, _ := http.NewRequest("GET", this.baseUrl+url, nil)
+	resp, err := this.do(req)
 	this.c.Assert(err, IsNil)
 	this.c.Assert(resp.StatusCode, Equals, http.StatusOK)
 	if result != nil {
@@ -88,7 +118,9 @@ func (this *node) post(url string, data interface{}, result interface{}) *http.R
 	var buf bytes.Buffer
 	err := json.NewEncoder(&buf).Encode(data)
 	this.c.Assert(err, IsNil)
-	resp, err := this.client.Post(this.baseUrl+url, "application/json", &buf)
+	req, _ := http.NewRequest("POST", this.baseUrl+url, &buf)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := this.do(req)
 	this.c.Assert(err, IsNil)
 	this.c.Assert(resp.StatusCode, Equals, http.StatusOK)
 	if result != nil {
@@ -104,7 +136,7 @@ func (this *node) put(url string, data interface{}, result interface{}) *http.Re
 	this.c.Assert(err, IsNil)
 	req, _ := http.NewRequest("PUT", this.baseUrl+url, &buf)
 	req.Header.Add("Content-Type", "application/json")
-	resp, err := this.client.Do(req)
+	resp, err := this.do(req)
 	this.c.Assert(err, IsNil)
 	this.c.Assert(resp.StatusCode, Equals, http.StatusOK)
 	if result != nil {
@@ -114,6 +146,22 @@ func (this *node) put(url string, data interface{}, result interface{}) *http.Re
 	return resp
 }
 
+func (this *node) getWithHeader(url string, header string, value string) *http.Response {
+	req, _ := http.NewRequest("GET", this.baseUrl+url, nil)
+	req.Header.Set(header, value)
+	resp, err := this.do(req)
+	this.c.Assert(err, IsNil)
+	return resp
+}
+
+func (this *node) delete(url string) *http.Response {
+	req, _ := http.NewRequest("DELETE", this.baseUrl+url, nil)
+	resp, err := this.do(req)
+	this.c.Assert(err, IsNil)
+	this.c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	return resp
+}
+
 func (this *TestApiSuite) TestBasic(c *C) {
 	this.C = c
 
@@ -142,9 +190,15 @@ func (this *TestApiSuite) TestBasic(c *C) {
 
 	time.Sleep(1 * time.Second)
 
-	var keys []CollectionItemJson
-	bob.get("/api/collections/"+cid+"/data", &keys)
+	var list ListJson
+	bob.get("/api/collections/"+cid+"/data", &list)
+	keys := list.Items
 	bob.Log.Printf("Got keys: %v", keys)
+	c.Assert(keys, HasLen, 1)
+	c.Assert(keys[0].Key, Equals, "some_key")
+	c.Assert(keys[0].Size, Equals, int64(len("\"SomeJsonCrap\"\n")))
+	c.Assert(keys[0].ContentType, Equals, "application/json")
+	c.Assert(keys[0].Author, Equals, selfAlice.Id)
 
 	var r string
 	bob.get("/api/collections/"+cid+"/data/some_key", &r)
@@ -152,6 +206,571 @@ func (this *TestApiSuite) TestBasic(c *C) {
 	bob.Log.Printf("GOT: %s", r)
 	c.Assert(r, Equals, "SomeJsonCrap")
 
+	resp := bob.get("/api/collections/"+cid+"/data/some_key", nil)
+	etag := resp.Header.Get("ETag")
+	c.Assert(etag, Not(Equals), "")
+	resp = bob.getWithHeader("/api/collections/"+cid+"/data/some_key", "If-None-Match", etag)
+	c.Assert(resp.StatusCode, Equals, http.StatusNotModified)
+	resp = bob.getWithHeader("/api/collections/"+cid+"/data/some_key", "Range", "bytes=1-4")
+	c.Assert(resp.StatusCode, Equals, http.StatusPartialContent)
+	body, _ := ioutil.ReadAll(resp.Body)
+	c.Assert(string(body), Equals, "Some")
+
+	// Data is never sniffed or run, and types which might run are attachments
+	c.Assert(resp.Header.Get("Content-Type"), Equals, "application/json")
+	c.Assert(resp.Header.Get("X-Content-Type-Options"), Equals, "nosniff")
+	c.Assert(resp.Header.Get("Content-Security-Policy"), Equals, "sandbox")
+	c.Assert(resp.Header.Get("Content-Disposition"), Equals, "")
+	req, _ := http.NewRequest("PUT", alice.baseUrl+"/api/collections/"+cid+"/data/page",
+		strings.NewReader("<script>alert('hi')</script>"))
+	req.Header.Set("Content-Type", "text/html")
+	resp, err := alice.do(req)
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	resp = alice.get("/api/collections/"+cid+"/data/page", nil)
+	c.Assert(resp.Header.Get("Content-Type"), Equals, "application/octet-stream")
+	c.Assert(resp.Header.Get("Content-Disposition"), Equals, "attachment")
+	c.Assert(resp.Header.Get("X-Content-Type-Options"), Equals, "nosniff")
+	c.Assert(resp.Header.Get("Content-Security-Policy"), Equals, "sandbox")
+	alice.delete("/api/collections/" + cid + "/data/page")
+
+	bob.post("/api/collections/"+cid+"/pins", &PinJson{Policy: "on-demand"}, nil)
+	var pins []PinJson
+	bob.get("/api/collections/"+cid+"/pins", &pins)
+	c.Assert(pins, DeepEquals, []PinJson{{Key: "", Policy: "on-demand"}})
+	bob.delete("/api/collections/" + cid + "/pins")
+	pins = nil
+	bob.get("/api/collections/"+cid+"/pins", &pins)
+	c.Assert(pins, HasLen, 0)
+
+	alice.delete("/api/collections/" + cid + "/data/some_key")
+
+	time.Sleep(1 * time.Second)
+
+	list = ListJson{}
+	bob.get("/api/collections/"+cid+"/data", &list)
+	c.Assert(list.Items, HasLen, 0)
+
+	alice.delete("/api/collections/" + cid)
+
+	time.Sleep(1 * time.Second)
+
+	var cjs []CollectionJson
+	bob.get("/api/collections", &cjs)
+	for _, cj := range cjs {
+		c.Assert(cj.Id, Not(Equals), cid)
+	}
+
 	alice.Stop()
 	bob.Stop()
 }
+
+func (this *TestApiSuite) TestChanges(c *C) {
+	this.C = c
+
+	alice := this.NewTestNode("A", 10001, 2001)
+	var cj CollectionJson
+	alice.post("/api/collections", "", &cj)
+	url := "/api/collections/" + cj.Id + "/changes"
+	alice.put("/api/collections/"+cj.Id+"/data/first", "One", nil)
+
+	var changes []ChangeJson
+	alice.get(url, &changes)
+	c.Assert(changes, HasLen, 1)
+	c.Assert(changes[0].Key, Equals, "first")
+	c.Assert(changes[0].Deleted, Equals, false)
+	since := fmt.Sprintf("%d", changes[0].Seq)
+
+	// Nothing new, so it waits, then gives up
+	changes = nil
+	alice.get(url+"?wait=1&since="+since, &changes)
+	c.Assert(changes, HasLen, 0)
+
+	// A poll gets woken up by a change
+	done := make(chan []ChangeJson)
+	go func() {
+		var changes []ChangeJson
+		alice.get(url+"?since="+since, &changes)
+		done <- changes
+	}()
+	time.Sleep(500 * time.Millisecond)
+	alice.delete("/api/collections/" + cj.Id + "/data/first")
+	changes = <-done
+	c.Assert(changes, HasLen, 1)
+	c.Assert(changes[0].Key, Equals, "first")
+	c.Assert(changes[0].Deleted, Equals, true)
+
+	// Event streams get everything after the last event
+	req, _ := http.NewRequest("GET", alice.baseUrl+url, nil)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Last-Event-ID", since)
+	resp, err := alice.do(req)
+	c.Assert(err, IsNil)
+	c.Assert(resp.Header.Get("Content-Type"), Equals, "text/event-stream")
+	reader := bufio.NewReader(resp.Body)
+	alice.put("/api/collections/"+cj.Id+"/data/second", "Two", nil)
+	keys := []string{}
+	for len(keys) < 2 {
+		line, err := reader.ReadString('\n')
+		c.Assert(err, IsNil)
+		if strings.HasPrefix(line, "data: ") {
+			var change ChangeJson
+			c.Assert(json.Unmarshal([]byte(line[6:]), &change), IsNil)
+			keys = append(keys, change.Key)
+		}
+	}
+	c.Assert(keys, DeepEquals, []string{"first", "second"})
+	resp.Body.Close()
+
+	alice.Stop()
+}
+
+func (this *TestApiSuite) TestEvents(c *C) {
+	this.C = c
+
+	alice := this.NewTestNode("A", 10001, 2001)
+	bob := this.NewTestNode("B", 10002, 2002)
+
+	dialer := &websocket.Dialer{
+		NetDial: func(proto, addr string) (net.Conn, error) {
+			return this.ConnMgr.Dial(proto, addr, conn.DialTimeout)
+		},
+	}
+	// Browsers can't set headers on websockets, so the token is in the query
+	ws, _, err := dialer.Dial("ws://localhost:2001/api/events?token="+alice.token, nil)
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	var selfAlice, selfBob SelfJson
+	alice.get("/api/self", &selfAlice)
+	bob.get("/api/self", &selfBob)
+	bob.post("/api/friends", &FriendJson{SelfJson: SelfJson{Passport: selfAlice.Passport}}, nil)
+	alice.post("/api/friends", &FriendJson{SelfJson: SelfJson{Passport: selfBob.Passport}}, nil)
+	time.Sleep(1 * time.Second)
+
+	var cj CollectionJson
+	bob.post("/api/collections", "", &cj)
+	bob.post("/api/invites", &InviteJson{Cid: cj.Id, Friend: selfAlice.Id}, nil)
+	alice.post("/api/invites", &InviteJson{Cid: cj.Id, Friend: selfBob.Id}, nil)
+	bob.put("/api/collections/"+cj.Id+"/data/some_key", "SomeJsonCrap", nil)
+
+	// Alice hears about bob, his subscription, and the download of his data
+	seen := make(map[string]bool)
+	ws.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for !seen["download finished"] {
+		var event EventJson
+		c.Assert(ws.ReadJSON(&event), IsNil)
+		seen[event.Type+" "+event.Event] = true
+		if event.Type == "friend" || event.Type == "subscribe" {
+			c.Assert(event.Friend, Equals, selfBob.Id)
+		}
+	}
+	c.Assert(seen["friend added"], Equals, true)
+	c.Assert(seen["subscribe subscribe"], Equals, true)
+	c.Assert(seen["download started"], Equals, true)
+
+	alice.Stop()
+	bob.Stop()
+}
+
+func (this *TestApiSuite) TestList(c *C) {
+	this.C = c
+
+	alice := this.NewTestNode("A", 10001, 2001)
+	var cj CollectionJson
+	alice.post("/api/collections", "", &cj)
+	url := "/api/collections/" + cj.Id + "/data"
+	for _, key := range []string{"b1", "a3", "a1", "a2", "c1"} {
+		alice.put(url+"/"+key, key, nil)
+	}
+
+	// Page through by key
+	keys := []string{}
+	next := ""
+	for {
+		var page ListJson
+		resp := alice.get(url+"?limit=2&after="+next, &page)
+		for _, item := range page.Items {
+			keys = append(keys, item.Key)
+		}
+		// The cursor is in the body, and the header too
+		c.Assert(resp.Header.Get("X-Next"), Equals, page.Next)
+		next = page.Next
+		if next == "" {
+			break
+		}
+		c.Assert(page.Items, HasLen, 2)
+	}
+	c.Assert(keys, DeepEquals, []string{"a1", "a2", "a3", "b1", "c1"})
+
+	// Only some of them, in the order they were written
+	var page ListJson
+	alice.get(url+"?prefix=a&order=seqno&limit=2", &page)
+	c.Assert(page.Items, HasLen, 2)
+	c.Assert(page.Items[0].Key, Equals, "a3")
+	c.Assert(page.Items[1].Key, Equals, "a1")
+	c.Assert(page.Next, Not(Equals), "")
+	after := page.Next
+	page = ListJson{}
+	resp := alice.get(url+"?prefix=a&order=seqno&after="+after, &page)
+	c.Assert(page.Items, HasLen, 1)
+	c.Assert(page.Items[0].Key, Equals, "a2")
+	c.Assert(page.Next, Equals, "")
+	c.Assert(resp.Header.Get("X-Next"), Equals, "")
+
+	alice.Stop()
+}
+
+func (this *TestApiSuite) TestNamespaces(c *C) {
+	this.C = c
+
+	alice := this.NewTestNode("A", 10001, 2001)
+	var cj CollectionJson
+	alice.post("/api/collections", "", &cj)
+	url := "/api/collections/" + cj.Id
+	for _, key := range []string{"photos/a", "photos/2023/x", "photos/2023/y", "photos/2024/z", "photos/b", "music/m"} {
+		alice.put(url+"/data/"+key, key, nil)
+	}
+
+	// Page through the immediate children of photos/
+	items := []CollectionItemJson{}
+	next := ""
+	for {
+		var page ListJson
+		alice.get(url+"/data?delimiter=/&prefix=photos/&limit=2&after="+next, &page)
+		items = append(items, page.Items...)
+		next = page.Next
+		if next == "" {
+			break
+		}
+	}
+	c.Assert(items, HasLen, 4)
+	c.Assert(items[0].Key, Equals, "photos/2023/")
+	c.Assert(items[0].Prefix, Equals, true)
+	c.Assert(items[1].Key, Equals, "photos/2024/")
+	c.Assert(items[2].Key, Equals, "photos/a")
+	c.Assert(items[2].Prefix, Equals, false)
+	c.Assert(items[3].Key, Equals, "photos/b")
+
+	// Move a directory, then delete it
+	var count CountJson
+	alice.post(url+"/rename", RenameJson{From: "photos/2023/", To: "old/", Recursive: true}, &count)
+	c.Assert(count.Count, Equals, 2)
+	var page ListJson
+	alice.get(url+"/data?delimiter=/", &page)
+	c.Assert(page.Items, HasLen, 3)
+	c.Assert(page.Items[0].Key, Equals, "music/")
+	c.Assert(page.Items[1].Key, Equals, "old/")
+	c.Assert(page.Items[2].Key, Equals, "photos/")
+	resp := alice.delete(url + "/data?prefix=old/")
+	c.Assert(json.NewDecoder(resp.Body).Decode(&count), IsNil)
+	c.Assert(count.Count, Equals, 2)
+	page = ListJson{}
+	alice.get(url+"/data?prefix=old/", &page)
+	c.Assert(page.Items, HasLen, 0)
+
+	alice.Stop()
+}
+
+func (this *TestApiSuite) TestHistory(c *C) {
+	this.C = c
+
+	alice := this.NewTestNode("A", 10001, 2001)
+	var cj CollectionJson
+	alice.post("/api/collections", "", &cj)
+	url := "/api/collections/" + cj.Id
+	var retention RetentionJson
+	alice.get(url+"/retention", &retention)
+	c.Assert(retention.Versions, Equals, 0)
+	alice.put(url+"/retention", RetentionJson{2}, nil)
+
+	// Overwrite a document a few times, the oldest falls off
+	for _, text := range []string{"one", "two", "three", "four"} {
+		alice.put(url+"/data/doc", text, nil)
+	}
+	var versions []VersionJson
+	alice.get(url+"/data/doc?history", &versions)
+	c.Assert(versions, HasLen, 2)
+	c.Assert(versions[0].Version, Equals, 3)
+	c.Assert(versions[1].Version, Equals, 2)
+	c.Assert(versions[0].Author, Equals, alice.Ident.Fingerprint().String())
+	resp := alice.get(url+"/data/doc?version=2", nil)
+	body, _ := ioutil.ReadAll(resp.Body)
+	c.Assert(string(body), Equals, "\"two\"\n")
+	resp = alice.getWithHeader(url+"/data/doc?version=1", "Accept", "*/*")
+	c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+
+	// Restore an accidental delete, which keeps what was deleted, but not the delete itself
+	alice.delete(url + "/data/doc")
+	var item CollectionItemJson
+	alice.post(url+"/restore", RestoreJson{Key: "doc", Version: 3}, &item)
+	c.Assert(item.Key, Equals, "doc")
+	resp = alice.get(url+"/data/doc", nil)
+	body, _ = ioutil.ReadAll(resp.Body)
+	c.Assert(string(body), Equals, "\"three\"\n")
+	versions = nil
+	alice.get(url+"/data/doc?history", &versions)
+	c.Assert(versions, HasLen, 2)
+	c.Assert(versions[0].Version, Equals, 4)
+	c.Assert(versions[1].Version, Equals, 3)
+
+	alice.Stop()
+}
+
+func (this *TestApiSuite) TestTokens(c *C) {
+	this.C = c
+
+	alice := this.NewTestNode("A", 10001, 2001)
+	var cj, other CollectionJson
+	alice.post("/api/collections", "", &cj)
+	alice.post("/api/collections", "", &other)
+	status := func(method string, url string, token string) int {
+		req, _ := http.NewRequest(method, alice.baseUrl+url, strings.NewReader("data"))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := alice.client.Do(req)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	url := "/api/collections/" + cj.Id + "/data/key"
+
+	// Without a good token, nothing is allowed
+	c.Assert(status("GET", "/api/self", ""), Equals, http.StatusUnauthorized)
+	c.Assert(status("GET", "/api/self", "bogus"), Equals, http.StatusUnauthorized)
+	// Tokens in the query only work for the event stream
+	c.Assert(status("GET", "/api/self?token="+alice.token, ""), Equals, http.StatusUnauthorized)
+
+	// Read-only tokens can't change anything
+	read, err := CreateToken(alice.Db, "read", ScopeRead, "")
+	c.Assert(err, IsNil)
+	c.Assert(status("GET", "/api/self", read), Equals, http.StatusOK)
+	c.Assert(status("PUT", url, read), Equals, http.StatusForbidden)
+
+	// Collection tokens only work for their collection
+	_, err = CreateToken(alice.Db, "read", ScopeRead, "")
+	c.Assert(err, NotNil)
+	_, err = CreateToken(alice.Db, "nocid", ScopeCollection, "")
+	c.Assert(err, NotNil)
+	one, err := CreateToken(alice.Db, "one", ScopeCollection, cj.Id)
+	c.Assert(err, IsNil)
+	c.Assert(status("PUT", url, one), Equals, http.StatusOK)
+	c.Assert(status("GET", url, one), Equals, http.StatusOK)
+	c.Assert(status("GET", "/api/collections/"+other.Id+"/data", one), Equals, http.StatusForbidden)
+	c.Assert(status("GET", "/api/friends", one), Equals, http.StatusForbidden)
+	// Or the collection itself
+	c.Assert(status("GET", "/api/collections/"+cj.Id, one), Equals, http.StatusForbidden)
+	c.Assert(status("DELETE", "/api/collections/"+cj.Id, one), Equals, http.StatusForbidden)
+	c.Assert(status("POST", "/api/collections/"+cj.Id+"/writers", one), Equals, http.StatusForbidden)
+	c.Assert(status("POST", "/api/collections/"+cj.Id+"/readers", one), Equals, http.StatusForbidden)
+
+	// Revoked tokens stop working
+	c.Assert(ListTokens(alice.Db), HasLen, 3)
+	c.Assert(RevokeToken(alice.Db, "one"), Equals, true)
+	c.Assert(RevokeToken(alice.Db, "one"), Equals, false)
+	c.Assert(status("GET", url, one), Equals, http.StatusUnauthorized)
+
+	// Logging in sets a cookie the browser sends instead
+	jar, _ := cookiejar.New(nil)
+	browser := &http.Client{Transport: alice.client.Transport, Jar: jar}
+	browseFrom := func(origin string, method string, url string, body string) int {
+		req, _ := http.NewRequest(method, alice.baseUrl+url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		resp, err := browser.Do(req)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	browse := func(method string, url string, body string) int {
+		return browseFrom("", method, url, body)
+	}
+	c.Assert(browse("POST", "/api/login", `{"token": "bogus"}`), Equals, http.StatusUnauthorized)
+	c.Assert(browse("GET", "/api/self", ""), Equals, http.StatusUnauthorized)
+	c.Assert(browse("POST", "/api/login", `{"token": "`+read+`"}`), Equals, http.StatusOK)
+	c.Assert(browse("GET", "/api/self", ""), Equals, http.StatusOK)
+	c.Assert(browse("PUT", url, "data"), Equals, http.StatusForbidden)
+	// Pages of other origins, including sandboxed data, can't use it, or log in
+	c.Assert(browseFrom(alice.baseUrl, "GET", "/api/self", ""), Equals, http.StatusOK)
+	c.Assert(browseFrom("null", "GET", "/api/self", ""), Equals, http.StatusUnauthorized)
+	c.Assert(browseFrom("http://evil.example", "GET", "/api/self", ""), Equals, http.StatusUnauthorized)
+	c.Assert(browseFrom("null", "POST", "/api/login", `{"token": "`+read+`"}`), Equals, http.StatusForbidden)
+	c.Assert(browse("DELETE", "/api/login", ""), Equals, http.StatusOK)
+	c.Assert(browse("GET", "/api/self", ""), Equals, http.StatusUnauthorized)
+
+	alice.Stop()
+}
+
+func (this *TestApiSuite) TestTls(c *C) {
+	this.C = c
+
+	alice := this.newNode("A", 10001, 2001, true)
+	var self SelfJson
+	resp := alice.get("/api/self", &self)
+	c.Assert(resp.TLS, NotNil)
+	c.Assert(resp.TLS.PeerCertificates, Not(HasLen), 0)
+
+	// The key the server uses is the one fingerprinted, however often the cert is made
+	fingerprint, err := TlsFingerprint(alice.Ident.TlsCertificate())
+	c.Assert(err, IsNil)
+	c.Assert(SpkiFingerprint(resp.TLS.PeerCertificates[0]), Equals, fingerprint)
+	c.Assert(strings.HasPrefix(fingerprint, "sha256//"), Equals, true)
+
+	alice.Stop()
+}
+
+func (this *TestApiSuite) TestInvites(c *C) {
+	this.C = c
+
+	alice := this.NewTestNode("A", 10001, 2001)
+	bob := this.NewTestNode("B", 10002, 2002)
+	var selfAlice, selfBob SelfJson
+	alice.get("/api/self", &selfAlice)
+	bob.get("/api/self", &selfBob)
+	bob.post("/api/friends", &FriendJson{SelfJson: SelfJson{Passport: selfAlice.Passport}}, nil)
+	alice.post("/api/friends", &FriendJson{SelfJson: SelfJson{Passport: selfBob.Passport}}, nil)
+	time.Sleep(1 * time.Second)
+
+	// Alice invites bob to write her collection
+	var cj CollectionJson
+	alice.post("/api/collections", "", &cj)
+	alice.post("/api/friends/"+selfBob.Id+"/invites", &InviteJson{Cid: cj.Id, Role: "writer"}, nil)
+	time.Sleep(3 * time.Second)
+
+	var invites []InviteJson
+	bob.get("/api/invites", &invites)
+	c.Assert(invites, HasLen, 1)
+	c.Assert(invites[0].Cid, Equals, cj.Id)
+	c.Assert(invites[0].Friend, Equals, selfAlice.Id)
+	c.Assert(invites[0].Role, Equals, "writer")
+	c.Assert(invites[0].State, Equals, "pending")
+
+	// Bob accepts, and can write
+	bob.post("/api/invites", &InviteJson{Cid: cj.Id, Friend: selfAlice.Id, Action: "accept"}, nil)
+	time.Sleep(3 * time.Second)
+	invites = nil
+	alice.get("/api/invites", &invites)
+	c.Assert(invites, HasLen, 1)
+	c.Assert(invites[0].Outgoing, Equals, true)
+	c.Assert(invites[0].State, Equals, "accepted")
+	time.Sleep(3 * time.Second)
+	bob.put("/api/collections/"+cj.Id+"/data/hello", "World", nil)
+
+	// By now they've talked, so each knows the other's key
+	var friend FriendJson
+	alice.get("/api/friends/"+selfBob.Id, &friend)
+	c.Assert(friend.PublicKey, Equals, selfBob.PublicKey)
+
+	alice.Stop()
+	bob.Stop()
+}
+
+func (this *TestApiSuite) TestConflicts(c *C) {
+	this.C = c
+
+	alice := this.NewTestNode("A", 10001, 2001)
+	bob := this.NewTestNode("B", 10002, 2002)
+	var selfAlice, selfBob SelfJson
+	alice.get("/api/self", &selfAlice)
+	bob.get("/api/self", &selfBob)
+	bob.post("/api/friends", &FriendJson{SelfJson: SelfJson{Passport: selfAlice.Passport}}, nil)
+	alice.post("/api/friends", &FriendJson{SelfJson: SelfJson{Passport: selfBob.Passport}}, nil)
+	time.Sleep(1 * time.Second)
+
+	// Bob can write alice's collection, and has the document
+	var cj CollectionJson
+	alice.post("/api/collections", "", &cj)
+	url := "/api/collections/" + cj.Id
+	alice.post("/api/invites", &InviteJson{Cid: cj.Id, Friend: selfBob.Id}, nil)
+	bob.post("/api/invites", &InviteJson{Cid: cj.Id, Friend: selfAlice.Id}, nil)
+	alice.post(url+"/writers", selfBob.PublicKey, nil)
+	alice.put(url+"/data/doc", "base", nil)
+	for i := 0; i < 20 && bob.api.Get(cj.Id, "doc") == nil; i++ {
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	// Both change it while they aren't talking
+	alice.post("/api/invites", &InviteJson{Cid: cj.Id, Friend: selfBob.Id, Remove: true}, nil)
+	bob.post("/api/invites", &InviteJson{Cid: cj.Id, Friend: selfAlice.Id, Remove: true}, nil)
+	time.Sleep(3 * time.Second)
+	alice.put(url+"/data/doc", "alice", nil)
+	bob.put(url+"/data/doc", "bob", nil)
+	alice.post("/api/invites", &InviteJson{Cid: cj.Id, Friend: selfBob.Id}, nil)
+	bob.post("/api/invites", &InviteJson{Cid: cj.Id, Friend: selfAlice.Id}, nil)
+	for i := 0; i < 20 && alice.api.GetConflict(cj.Id, "doc") == nil; i++ {
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	var conflicts []ConflictJson
+	alice.get(url+"/conflicts", &conflicts)
+	c.Assert(conflicts, HasLen, 1)
+	c.Assert(conflicts[0].Key, Equals, "doc")
+	c.Assert(conflicts[0].Siblings, HasLen, 2)
+	resp := alice.get(url+"/data/doc?author="+selfBob.Id, nil)
+	body, _ := ioutil.ReadAll(resp.Body)
+	c.Assert(string(body), Equals, "\"bob\"\n")
+	var conflict ConflictJson
+	alice.get(url+"/conflicts/doc", &conflict)
+	c.Assert(conflict.Siblings[0].Current != conflict.Siblings[1].Current, Equals, true)
+
+	// Alice merges them
+	var item CollectionItemJson
+	alice.put(url+"/conflicts/doc", "alice and bob", &item)
+	c.Assert(item.Author, Equals, selfAlice.Id)
+	resp = alice.getWithHeader(url+"/conflicts/doc", "Accept", "application/json")
+	c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+	time.Sleep(3 * time.Second)
+	conflicts = nil
+	bob.get(url+"/conflicts", &conflicts)
+	c.Assert(conflicts, HasLen, 0)
+	resp = bob.get(url+"/data/doc", nil)
+	body, _ = ioutil.ReadAll(resp.Body)
+	c.Assert(string(body), Equals, "\"alice and bob\"\n")
+
+	alice.Stop()
+	bob.Stop()
+}
+
+func (this *TestApiSuite) TestCollectionInfo(c *C) {
+	this.C = c
+
+	alice := this.NewTestNode("A", 10001, 2001)
+	var cj CollectionJson
+	alice.post("/api/collections", &CollectionJson{Name: "Photos"}, &cj)
+	c.Assert(cj.Name, Equals, "Photos")
+	c.Assert(cj.Created, Not(Equals), "")
+	url := "/api/collections/" + cj.Id
+	alice.put(url+"/data/icon.png", "Pretty", nil)
+
+	var updated CollectionJson
+	alice.put(url, &CollectionJson{Name: "Holiday", Description: "Beach", IconKey: "icon.png"}, &updated)
+	c.Assert(updated.Name, Equals, "Holiday")
+	c.Assert(updated.Created, Equals, cj.Created)
+
+	// The icon is the ETag of its data
+	resp := alice.get(url+"/data/icon.png", nil)
+	c.Assert(resp.Header.Get("ETag"), Equals, `"`+updated.Icon+`"`)
+
+	var all []CollectionJson
+	alice.get("/api/collections", &all)
+	found := false
+	for _, col := range all {
+		if col.Id == cj.Id {
+			c.Assert(col.Description, Equals, "Beach")
+			c.Assert(col.IconKey, Equals, "icon.png")
+			found = true
+		}
+	}
+	c.Assert(found, Equals, true)
+
+	// Without a name or description, no info is set
+	var bare CollectionJson
+	alice.post("/api/collections", "", &bare)
+	c.Assert(bare.Name, Equals, "")
+	c.Assert(bare.Created, Equals, "")
+
+	alice.Stop()
+}
@@ -0,0 +1,221 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/gorilla/mux"
+	"h0tb0x/crypto"
+	"h0tb0x/db"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// What a token is allowed to do
+const (
+	ScopeRead       = iota // Read anything, change nothing
+	ScopeCollection        // Read and write the data of a single collection
+	ScopeAdmin             // Anything at all
+)
+
+// The names of scopes, as used by the token command and TokenJson
+var ScopeNames = map[int]string{
+	ScopeRead:       "read",
+	ScopeCollection: "collection",
+	ScopeAdmin:      "admin",
+}
+
+// How many random bytes are in a token
+const tokenSize = 24
+
+// The cookie login sets, so the web app, and its links and images, send the token
+const tokenCookie = "h0tb0x_token"
+
+type TokenJson struct {
+	Name    string `json:"name"`
+	Scope   string `json:"scope"`
+	Cid     string `json:"cid,omitempty"`
+	Created string `json:"created"`
+}
+
+type LoginJson struct {
+	Token string `json:"token"`
+}
+
+func hashToken(token string) string {
+	hasher := crypto.NewHasher()
+	hasher.Write([]byte(token))
+	return hasher.Finalize().String()
+}
+
+// Makes a new token, cid is the collection of a collection token.  The token itself is
+// returned, only its hash is stored, so there is no way to get it again.
+func CreateToken(thedb *db.Database, name string, scope int, cid string) (string, error) {
+	if _, ok := ScopeNames[scope]; !ok {
+		return "", fmt.Errorf("Unable to create token '%s', invalid scope", name)
+	}
+	if (scope == ScopeCollection) != (cid != "") {
+		return "", fmt.Errorf("Unable to create token '%s', only collection tokens have a cid", name)
+	}
+	if thedb.MaybeScan(thedb.SingleQuery("SELECT 1 FROM Token WHERE name = ?", name), new(int)) {
+		return "", fmt.Errorf("Unable to create token '%s', it already exists", name)
+	}
+	raw := make([]byte, tokenSize)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(raw)
+	thedb.Exec("INSERT INTO Token (name, hash, scope, topic, created) VALUES (?, ?, ?, ?, ?)",
+		name, hashToken(token), scope, cid, time.Now().Unix())
+	return token, nil
+}
+
+// Removes a token, returns false if there was none
+func RevokeToken(thedb *db.Database, name string) bool {
+	result := thedb.Exec("DELETE FROM Token WHERE name = ?", name)
+	count, _ := result.RowsAffected()
+	return count > 0
+}
+
+func ListTokens(thedb *db.Database) []TokenJson {
+	rows := thedb.MultiQuery("SELECT name, scope, topic, created FROM Token ORDER BY name")
+	out := []TokenJson{}
+	for rows.Next() {
+		var token TokenJson
+		var scope int
+		var created int64
+		thedb.Scan(rows, &token.Name, &scope, &token.Cid, &created)
+		token.Scope = ScopeNames[scope]
+		token.Created = time.Unix(created, 0).UTC().Format(time.RFC3339)
+		out = append(out, token)
+	}
+	return out
+}
+
+// Which calls a handler is for, and so which tokens it takes
+const (
+	routeApi    = iota // Anything but collection data, for read and admin tokens
+	routeData          // Collection data, for collection tokens too
+	routeEvents        // The event stream, which takes the token query parameter too
+)
+
+// Whether a request comes from a page of the API's own origin, by what browsers say.  Data is
+// sandboxed, so any page it makes has an opaque origin, and gets false here.
+func sameOrigin(req *http.Request) bool {
+	if site := req.Header.Get("Sec-Fetch-Site"); site != "" && site != "same-origin" && site != "none" {
+		return false
+	}
+	if origin := req.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host != req.Host {
+			return false
+		}
+	}
+	return true
+}
+
+// Gets the token of a request, from the Authorization header, or the login cookie if the
+// request is from our own origin.  If allowQuery is set, it may be in the token query
+// parameter too, which is only allowed where it has to be, since URLs end up in logs,
+// history and referers.
+func requestToken(req *http.Request, allowQuery bool) string {
+	auth := req.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(auth[len("Bearer "):])
+	}
+	if cookie, err := req.Cookie(tokenCookie); err == nil && sameOrigin(req) {
+		return cookie.Value
+	}
+	if allowQuery {
+		return req.URL.Query().Get("token")
+	}
+	return ""
+}
+
+// Gets the scope and collection of a token, false if there is no such token
+func (this *ApiMgr) lookupToken(token string) (scope int, topic string, ok bool) {
+	if token == "" {
+		return
+	}
+	row := this.Db.SingleQuery("SELECT scope, topic FROM Token WHERE hash = ?", hashToken(token))
+	ok = this.Db.MaybeScan(row, &scope, &topic)
+	return
+}
+
+// Wraps a handler for the given kind of route, so it's only called for requests with a
+// token allowing it
+func (this *ApiMgr) authorize(handler http.HandlerFunc, route int) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		// Browsers can't set headers on websockets
+		scope, topic, ok := this.lookupToken(requestToken(req, route == routeEvents))
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			this.sendError(w, http.StatusUnauthorized, "Invalid token")
+			return
+		}
+		switch scope {
+		case ScopeRead:
+			if req.Method != "GET" && req.Method != "HEAD" {
+				this.sendError(w, http.StatusForbidden, "Token is read-only")
+				return
+			}
+		case ScopeCollection:
+			if route != routeData {
+				this.sendError(w, http.StatusForbidden, "Token is only for collection data")
+				return
+			}
+			if mux.Vars(req)["cid"] != topic {
+				this.sendError(w, http.StatusForbidden, "Token is for another collection")
+				return
+			}
+		}
+		handler(w, req)
+	}
+}
+
+func (this *ApiMgr) setTokenCookie(w http.ResponseWriter, token string, maxAge int) {
+	// Strict, so other sites can't make calls with it
+	http.SetCookie(w, &http.Cookie{
+		Name:     tokenCookie,
+		Value:    token,
+		Path:     "/api",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   this.TlsCert != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// Checks a token from the token command, and sets it as the login cookie
+func (this *ApiMgr) postLogin(w http.ResponseWriter, req *http.Request) {
+	// So a page elsewhere can't swap in a token of its own
+	if !sameOrigin(req) {
+		this.sendError(w, http.StatusForbidden, "Login from another origin")
+		return
+	}
+	var login LoginJson
+	if !this.decodeJsonBody(w, req, &login) {
+		return
+	}
+	var token TokenJson
+	var scope int
+	var created int64
+	row := this.Db.SingleQuery("SELECT name, scope, topic, created FROM Token WHERE hash = ?",
+		hashToken(login.Token))
+	if login.Token == "" || !this.Db.MaybeScan(row, &token.Name, &scope, &token.Cid, &created) {
+		this.sendError(w, http.StatusUnauthorized, "Invalid token")
+		return
+	}
+	token.Scope = ScopeNames[scope]
+	token.Created = time.Unix(created, 0).UTC().Format(time.RFC3339)
+	this.setTokenCookie(w, login.Token, 0)
+	this.sendJson(w, token)
+}
+
+// Clears the login cookie
+func (this *ApiMgr) deleteLogin(w http.ResponseWriter, req *http.Request) {
+	this.setTokenCookie(w, "", -1)
+}
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"h0tb0x/sync"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long a poll for changes waits by default, and at most
+const (
+	DefaultChangeWait = 30 * time.Second
+	MaxChangeWait     = 5 * time.Minute
+)
+
+// How many changes are sent at once
+const maxChanges = 1000
+
+// How often an idle event stream sends something, to find out if the client went away
+const keepAliveInterval = 15 * time.Second
+
+// A change to a key, Seq is the cursor to pass as since to get the changes after it
+type ChangeJson struct {
+	CollectionItemJson
+	Seq     int64 `json:"seq"`
+	Deleted bool  `json:"deleted"`
+}
+
+func (this *ApiMgr) onChange(cid string, key string, data []byte, author string, isUp bool) {
+	this.changeLock.Lock()
+	this.changeGen++
+	this.changed.Broadcast()
+	this.changeLock.Unlock()
+}
+
+func (this *ApiMgr) changeGeneration() int {
+	this.changeLock.Lock()
+	defer this.changeLock.Unlock()
+	return this.changeGen
+}
+
+// Waits for a change after generation gen, returns false if there was none by the deadline
+func (this *ApiMgr) waitChange(gen int, deadline time.Time) bool {
+	this.changeLock.Lock()
+	defer this.changeLock.Unlock()
+	timer := time.AfterFunc(deadline.Sub(time.Now()), func() {
+		this.changeLock.Lock()
+		this.changed.Broadcast()
+		this.changeLock.Unlock()
+	})
+	defer timer.Stop()
+	for this.changeGen == gen && !this.closing && time.Now().Before(deadline) {
+		this.changed.Wait()
+	}
+	return this.changeGen != gen
+}
+
+func (this *ApiMgr) isClosing() bool {
+	this.changeLock.Lock()
+	defer this.changeLock.Unlock()
+	return this.closing
+}
+
+// Gets the latest change to each key changed after since, oldest first.  Since every
+// write gets a new sequence number, a key shows up once, with its current value.
+func (this *ApiMgr) changesSince(cid string, since int64) []ChangeJson {
+	rows := this.Db.MultiQuery(`
+		SELECT key, MAX(seqno) AS seq FROM Object
+		WHERE type = ? AND topic = ? AND seqno > ?
+		GROUP BY key
+		ORDER BY seq
+		LIMIT ?`,
+		sync.RTData, cid, since, maxChanges)
+	out := []ChangeJson{}
+	for rows.Next() {
+		var change ChangeJson
+		this.Db.Scan(rows, &change.Key, &change.Seq)
+		out = append(out, change)
+	}
+	for i := range out {
+		item, ok := this.collectionItem(cid, out[i].Key)
+		out[i].CollectionItemJson = item
+		out[i].Deleted = !ok
+	}
+	return out
+}
+
+func (this *ApiMgr) getChanges(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	cid := vars["cid"]
+	if this.GetOwner(cid) == nil || this.IsClosed(cid) {
+		this.sendError(w, http.StatusNotFound, "No such collection")
+		return
+	}
+	// Event streams resume from the last event they saw
+	cursor := req.URL.Query().Get("since")
+	if last := req.Header.Get("Last-Event-ID"); last != "" {
+		cursor = last
+	}
+	since := int64(0)
+	if cursor != "" {
+		var err error
+		since, err = strconv.ParseInt(cursor, 10, 64)
+		if err != nil {
+			this.sendError(w, http.StatusBadRequest, "Invalid since")
+			return
+		}
+	}
+	if strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+		this.streamChanges(w, cid, since)
+		return
+	}
+	wait := DefaultChangeWait
+	if str := req.URL.Query().Get("wait"); str != "" {
+		secs, err := strconv.Atoi(str)
+		if err != nil || secs < 0 {
+			this.sendError(w, http.StatusBadRequest, "Invalid wait")
+			return
+		}
+		wait = time.Duration(secs) * time.Second
+		if wait > MaxChangeWait {
+			wait = MaxChangeWait
+		}
+	}
+	deadline := time.Now().Add(wait)
+	for {
+		gen := this.changeGeneration()
+		changes := this.changesSince(cid, since)
+		if len(changes) > 0 || !this.waitChange(gen, deadline) {
+			this.sendJson(w, changes)
+			return
+		}
+	}
+}
+
+// Sends changes as server-sent events, until the client goes away
+func (this *ApiMgr) streamChanges(w http.ResponseWriter, cid string, since int64) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		this.sendError(w, http.StatusInternalServerError, "Streaming not supported")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for !this.isClosing() {
+		gen := this.changeGeneration()
+		changes := this.changesSince(cid, since)
+		for _, change := range changes {
+			data, _ := json.Marshal(change)
+			_, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", change.Seq, data)
+			if err != nil {
+				return
+			}
+			since = change.Seq
+		}
+		flusher.Flush()
+		if len(changes) == maxChanges {
+			continue
+		}
+		if !this.waitChange(gen, time.Now().Add(keepAliveInterval)) {
+			_, err := io.WriteString(w, ": keep-alive\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
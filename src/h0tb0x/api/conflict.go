@@ -0,0 +1,112 @@
+package api
+
+import (
+	"github.com/gorilla/mux"
+	"h0tb0x/meta"
+	"io"
+	"net/http"
+	"time"
+)
+
+// One writer's value of a conflicting key
+type SiblingJson struct {
+	Author      string            `json:"author"`
+	Current     bool              `json:"current"` // The value the data of the key has now
+	Deleted     bool              `json:"deleted"`
+	Size        int64             `json:"size"`
+	ContentType string            `json:"contentType,omitempty"`
+	ModTime     string            `json:"modTime,omitempty"`
+	Attrs       map[string]string `json:"attrs"`
+}
+
+type ConflictJson struct {
+	Key      string        `json:"key"`
+	Detected string        `json:"detected"`
+	Siblings []SiblingJson `json:"siblings"`
+}
+
+func (this *ApiMgr) conflictJson(cid string, conflict *meta.Conflict) ConflictJson {
+	out := ConflictJson{
+		Key:      conflict.Key,
+		Detected: conflict.Detected.UTC().Format(time.RFC3339),
+		Siblings: []SiblingJson{},
+	}
+	for _, sibling := range conflict.Siblings {
+		item := SiblingJson{
+			Author:  sibling.Author,
+			Current: sibling.Current,
+			Deleted: sibling.Deleted,
+			Attrs:   map[string]string{},
+		}
+		if rec, err := this.GetSiblingRecord(cid, conflict.Key, sibling.Author); err == nil {
+			item.Size = rec.Size
+			item.ContentType = rec.ContentType
+			item.Attrs = rec.Attrs
+			if rec.ModTime != 0 {
+				item.ModTime = time.Unix(rec.ModTime, 0).UTC().Format(time.RFC3339)
+			}
+		}
+		out.Siblings = append(out.Siblings, item)
+	}
+	return out
+}
+
+func (this *ApiMgr) getConflicts(w http.ResponseWriter, req *http.Request) {
+	cid := mux.Vars(req)["cid"]
+	if this.GetOwner(cid) == nil {
+		this.sendError(w, http.StatusNotFound, "Collection invalid")
+		return
+	}
+	out := []ConflictJson{}
+	for _, conflict := range this.GetConflicts(cid) {
+		out = append(out, this.conflictJson(cid, conflict))
+	}
+	this.sendJson(w, out)
+}
+
+func (this *ApiMgr) getConflict(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	cid := vars["cid"]
+	conflict := this.GetConflict(cid, vars["key"])
+	if conflict == nil {
+		this.sendError(w, http.StatusNotFound, "No such conflict")
+		return
+	}
+	this.sendJson(w, this.conflictJson(cid, conflict))
+}
+
+// Sends the data of one writer's value of a conflicting key
+func (this *ApiMgr) getSiblingData(w http.ResponseWriter, req *http.Request, cid string, key string) {
+	author := req.URL.Query().Get("author")
+	rec, err := this.GetSiblingRecord(cid, key, author)
+	if err != nil {
+		this.sendError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	this.sendKept(w, req, rec, func(out io.Writer, wait time.Duration) error {
+		return this.GetSiblingData(cid, key, author, out, wait)
+	})
+}
+
+// Puts the merged data of a conflicting key, which replaces every sibling
+func (this *ApiMgr) resolveConflict(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	cid := vars["cid"]
+	key := vars["key"]
+	writer := this.GetWriter(cid, this.Ident.Public().Fingerprint().String())
+	if writer == nil {
+		this.sendError(w, http.StatusUnauthorized, "You are not a writer for this collection")
+		return
+	}
+	if this.GetConflict(cid, key) == nil {
+		this.sendError(w, http.StatusNotFound, "No such conflict")
+		return
+	}
+	err := this.PutDataRecord(cid, key, this.Ident, req.Body, headerRecord(req))
+	if err != nil {
+		this.sendError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	item, _ := this.collectionItem(cid, key)
+	this.sendJson(w, item)
+}
@@ -8,6 +8,39 @@ Users curate data organized into collections, and each user may authorize their
 Users communicate changes to collections via signed messages. A change is valid if its author belongs to the group of authorized writers for that collection.
 
 
+Authentication
+
+The API listens on ApiHost from the config, 127.0.0.1 unless set otherwise.  Every call but login
+needs a bearer token, in an Authorization header, or the login cookie.  /api/events also takes it
+in a token query parameter, since browsers can't set headers on websockets.  Tokens are made with
+"h0tb0x token create <name> <scope>", listed with "h0tb0x token list" and revoked with
+"h0tb0x token revoke <name>".  The scopes are:
+	read -- any GET call
+	collection <cid> -- the data, changes, rename, restore and conflicts calls on
+		/api/collections/{cid}, but not the collection itself, its writers, readers,
+		pins or retention
+	admin -- any call
+A missing or unknown token gets 401, and a token without the scope for a call gets 403.
+The login cookie is only taken from pages of the API's own origin, going by the Origin and
+Sec-Fetch-Site headers browsers send.  Data is served sandboxed, so a page stored as data
+can't make calls with it.
+
+/api/login
+
+	POST		Check a token, and set it as an HttpOnly cookie, which the browser then sends with
+			every call, as the web app does.  It is SameSite=Strict, so other sites can't use it,
+			and a login from another origin gets 403.
+			request body:	json-encoded object with the token.
+			returns: json-encoded object with the name, scope, cid and creation time of the token.
+
+	DELETE		Clear the login cookie.
+
+With ApiTls set in the config, the API is served over https, with a certificate made from the node
+identity, or with ApiCert and ApiKey, PEM files, if they are set.  The certificate isn't signed by
+anyone a client trusts, so clients pin its key instead, with the fingerprint printed on startup,
+which is in the form "curl --pinnedpubkey" takes.
+
+
 Self
 
 Self identifies the currently authenticated profile. Users may have many profiles.
@@ -19,10 +52,37 @@ Self identifies the currently authenticated profile. Users may have many profile
 
 
 
+Storage
+
+Blobs written locally or pinned are always kept.  If a quota is configured, the least recently
+used blobs from friends are evicted when it is exceeded, and downloaded again when next needed.
+
+/api/storage
+
+	GET		Get storage usage and eviction statistics.
+			returns: json-encoded object with quota, used, kept and evictedBytes in bytes,
+			and counts of local blobs and evictions since startup.
+
+
+Events
+
+/api/events
+
+	GET		Open a websocket which gets a json-encoded object for each event, with a type, an event,
+			and a time.  Events the client falls behind on are dropped.  The types are:
+			friend -- a friend was added or removed, or the link to it started up, event is added,
+			          removed or startup, and friend is its fingerprint
+			subscribe -- a friend subscribed to or unsubscribed from a collection, event is
+			          subscribe or unsubscribe, friend is its fingerprint and topic is the collection id
+			download -- a blob download started, finished or failed, event is started, finished or
+			          failed, key is the digest of the blob, and error is why it failed
+
 
 Friends
 
 A friendship is a mutual relation between two profiles. Each user profile stores information corresponding to the other user as a friend object.
+The publicKey of a friend is known once it's given when adding the friend, or once the friends
+have connected, since the link handshake proves it.  A key which doesn't match the fingerprint is refused.
 
 /api/friends
 
@@ -56,9 +116,12 @@ A collection is a curated set of data with common authorized writers and authori
 /api/collections
 
 	GET		Get all collections associated with currently authenticated user profile.
-			returns: json-encoded set of objects representing all available collections
+			returns: json-encoded set of objects representing all available collections, with the
+			id, owner, private, and the name, description, iconKey, icon and created set by the owner
 
 	POST		Add a collection.
+			request body: optional json-encoded collection, set "private" to true to make a private
+			collection, name and description may be set too, and created is only set with them
 
 /api/collections/{cid}
 
@@ -68,6 +131,15 @@ A collection is a curated set of data with common authorized writers and authori
 	GET		Get a particular collection belonging to local user profile.
 			returns: json-encoded object representing the collection labeled {cid}
 
+	PUT		Set the name, description and icon of a collection, only the owner may do so.  They're
+			signed by the owner and shared with the collection, sealed if it's private.
+			request body: json-encoded object with the name, description and iconKey, the key of
+			data in the collection with the icon, icon is set to its digest
+			returns: json-encoded object representing the collection
+
+	DELETE		Close a collection, only the owner may do so.  Everyone sharing the collection
+			unsubscribes and removes its data.
+
 
 
 Collection writers
@@ -93,38 +165,187 @@ Collection writers
 
 
 
+Collection readers
+
+Data in a private collection is encrypted, and only readable by its readers. Writers must also be readers.
+
+/api/collections/{cid}/readers
+
+	GET		Get all readers of a private collection.
+			returns: json-encoded set of friends able to read collection labeled {cid}
+
+	POST		Add a friend as a reader of a private collection.
+			request body: json-encoded public key of the friend
+
+/api/collections/{cid}/readers/{who}
+
+	DELETE		Remove a friend from the readers of a private collection, the collection key is rotated
+			so they are unable to read anything written afterwards.
+
+
+
+Collection pins
+
+Pins set the download policy of a collection or a key.  The policy is one of "eager", download as soon
+as a friend has it and never evict it, "on-demand", download when it's asked for, or "never".  Without
+a pin, data is downloaded eagerly but may be evicted to stay under the storage quota.
+
+/api/collections/{cid}/pins
+
+	GET		Get the pins of a collection.
+			returns: json-encoded set of objects with key and policy, key is empty for the collection
+
+	POST		Set the policy of a key, or of the whole collection if key is empty.
+			request body: json-encoded object with key and policy
+
+	DELETE		Remove the collection pin.
+
+/api/collections/{cid}/pins/{key:.+}
+
+	DELETE		Remove the pin of a key.
+
+
+
 Collection data
 
 [	Definition	]
 
 /api/collections/{cid}/data
 
-	GET		Get data for a collection.
-			returns:
+	GET		Get data for a collection, a page at a time.
+			query: limit -- optional, how many keys to get, by default 1000, at most 10000
+			       prefix -- optional, only get keys starting with this
+			       order -- optional, key (the default) or seqno, which is the order they were written
+			       after -- optional, the cursor from next in the previous page
+			       delimiter -- optional, only with key order, keys with the delimiter after the
+			       prefix are listed once, as their common prefix up to and including it
+			returns: json-encoded object with items, a set of objects with the key, size,
+			contentType, modTime, author and attrs of each data element, and next.  Data
+			written before these were recorded only has a key and author.  A common prefix
+			only has the key, and prefix set to true.  If there are more keys, next, and the
+			X-Next header, have the cursor for the next page.  Deleted keys are skipped, so in
+			seqno order a page may be short.
+
+	DELETE		Delete every data element whose key starts with a prefix.
+			query: prefix -- required, and not empty
+			returns: json-encoded object with the count of keys deleted
+
+
+/api/collections/{cid}/rename
+
+	POST		Rename a data element, or with recursive, every data element starting with from, so
+			it starts with to instead.  Nothing is renamed if a new key already exists, or from
+			and to overlap.  Renames are a put of the new key and a delete of the old one.
+			request body: json-encoded object with from, to and recursive
+			returns: json-encoded object with the count of keys renamed
+
+
+/api/collections/{cid}/retention
+
+	GET		Get how many previous versions of each data element are kept.  This is a local
+			setting, by default none are kept.
+			returns: json-encoded object with versions
+
+	PUT		Set how many previous versions of each data element are kept, when a data element is
+			overwritten or deleted, its old value is kept along with its data.  Only values
+			replaced from then on are kept, and lowering it drops the oldest versions.
+			request body: json-encoded object with versions, 0 keeps none
+
+
+/api/collections/{cid}/restore
+
+	POST		Make a previous version of a data element the current one again, by putting it.  The
+			value it replaces becomes a previous version in turn.
+			request body: json-encoded object with the key and version
+			returns: json-encoded object with the fields of the restored data element
+
+
+/api/collections/{cid}/conflicts
+
+	GET		Get the keys which more than one writer changed at once, each working from the same
+			earlier value, in key order.  Both values are kept until someone writes the key
+			again, the data of the key is one of them.
+			returns: json-encoded set of objects with the key, when the conflict was detected,
+			and siblings, one for each writer, with the author, current (true for the value the
+			data of the key has), deleted, and the size, contentType, modTime and attrs of the value
+
+
+/api/collections/{cid}/conflicts/{key:.+}
+
+	GET		Get the conflict on a key, as above.
+
+	PUT		Resolve the conflict on a key by putting the merged data, as a PUT of its data does.
+			Fails if there is no conflict.
+			request body: the data
+			returns: json-encoded object with the fields of the data element
+
+
+/api/collections/{cid}/changes
+
+	GET		Wait for changes to the data of a collection.  Each change has the fields of a data element,
+			a seq, and a deleted flag.  A key which changed more than once only shows up once.
+			query: since -- optional, the seq of the last change seen, the default is to get everything
+			       wait -- optional, seconds to wait if there are no changes yet, by default 30, at most 300
+			returns: json-encoded set of changes, oldest first, which is empty if the wait ran out.
+			If the request accepts text/event-stream, the changes are sent as server-sent events
+			instead, with the seq as the event id, so Last-Event-ID resumes a stream.
 
 
 /api/collections/{cid}/data/{key:.+}
 
-	GET		Get collection data for a particular data element.
+	GET		Get collection data for a particular data element.  If it isn't local and is on-demand,
+			or was evicted, waits for it to be downloaded.
+			query: wait -- optional, seconds to wait for data which isn't local yet, it's downloaded
+				first and streamed as it arrives, failing if the download stalls for that long
+			       history -- optional, get the previous versions instead, as json-encoded set of
+				objects with the version, fields of a data element, and when it was replaced,
+				latest first
+			       version -- optional, get the data of a previous version instead, it's downloaded
+				if it isn't local
+			       author -- optional, get the data of this writer's value of a conflicting key
+				instead, it's downloaded if it isn't local
+			headers: the ETag is the digest of the data, so If-None-Match is supported.  Local data
+				of public collections also supports Range requests.  Any writer picks the type of
+				data, so it's sent with nosniff and a sandbox Content-Security-Policy.  Plain text,
+				json, and common image, audio and video types are served as the Content-Type stored
+				with the data, anything else, including html and svg, as an application/octet-stream
+				attachment.
 			returns:
 
-	PUT
-			request body:
+	PUT		Put a data element, its Content-Type is stored with it, as are X-Attr-{name} headers,
+			which set the attribute {name}.
+			request body: the data
 
-	POST
-			request body:
+	POST		Put a data element from a form.
+			request body: multipart form with a single file, its Content-Type is stored with it,
+			and the other fields are stored as attributes
 
-	DELETE		not implemented
+	DELETE		Delete a data element, the deletion is signed and propagates to everyone sharing the collection.
 
 
 
 Invitations
 
+The owner of a collection invites a friend to it as a reader or a writer.  The invite is sent to
+the friend, who accepts or rejects it.  Accepting subscribes to the collection, and the owner adds
+whoever accepted as a writer if that was the role, and as a reader if the collection is private.
 
 /api/invites
 
-POST		Post an invitation.
-		request body: inviteJson
+	GET		Get invitations, sent and received, newest first.
+			returns: json-encoded set of objects with the cid, friend, role (reader or writer),
+			state (pending, accepted or rejected), outgoing (true if sent by me) and created
+
+	POST		Answer an invitation, or subscribe to a collection.
+			request body: json-encoded object with the cid, the friend who sent the invite, and
+			action, accept or reject.  Without an action, subscribes to the collection from the
+			friend, or unsubscribes if remove is set.
+
+
+/api/friends/{who}/invites
+
+	POST		Invite a friend to a collection I own.
+			request body: json-encoded object with the cid and role, reader (the default) or writer
 
 */
 package api
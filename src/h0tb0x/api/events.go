@@ -0,0 +1,130 @@
+package api
+
+import (
+	"github.com/gorilla/websocket"
+	"h0tb0x/crypto"
+	"h0tb0x/data"
+	"h0tb0x/link"
+	"net/http"
+	"time"
+)
+
+// How many events are queued for a slow client before they are dropped
+const eventBacklog = 64
+
+// Something that happened, sent to everyone on /api/events
+type EventJson struct {
+	Type   string `json:"type"`  // friend, subscribe or download
+	Event  string `json:"event"` // What happened, depending on the type
+	Friend string `json:"friend,omitempty"`
+	Topic  string `json:"topic,omitempty"`
+	Key    string `json:"key,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Time   string `json:"time"`
+}
+
+var friendEvents = map[link.FriendStatus]string{
+	link.FriendStartup: "startup",
+	link.FriendAdded:   "added",
+	link.FriendRemoved: "removed",
+}
+
+var downloadEvents = map[data.DownloadStatus]string{
+	data.DownloadStarted:  "started",
+	data.DownloadFinished: "finished",
+	data.DownloadFailed:   "failed",
+}
+
+// Sends an event to every client, dropping it for clients which are behind
+func (this *ApiMgr) publish(event *EventJson) {
+	event.Time = time.Now().UTC().Format(time.RFC3339)
+	this.eventLock.Lock()
+	defer this.eventLock.Unlock()
+	for client, _ := range this.eventClients {
+		select {
+		case client <- event:
+		default:
+		}
+	}
+}
+
+func (this *ApiMgr) onFriendEvent(id int, fp *crypto.Digest, what link.FriendStatus) {
+	this.publish(&EventJson{Type: "friend", Event: friendEvents[what], Friend: fp.String()})
+}
+
+func (this *ApiMgr) onSubscribeEvent(id int, fp *crypto.Digest, topic string, enable bool) {
+	event := &EventJson{Type: "subscribe", Event: "subscribe", Friend: fp.String(), Topic: topic}
+	if !enable {
+		event.Event = "unsubscribe"
+	}
+	this.publish(event)
+}
+
+func (this *ApiMgr) onDownloadEvent(key string, what data.DownloadStatus, err error) {
+	event := &EventJson{Type: "download", Event: downloadEvents[what], Key: key}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	this.publish(event)
+}
+
+// Streams events to a websocket until either side closes
+func (this *ApiMgr) getEvents(w http.ResponseWriter, req *http.Request) {
+	var upgrader websocket.Upgrader
+	ws, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		// The upgrader has already replied
+		return
+	}
+	defer ws.Close()
+
+	events := make(chan *EventJson, eventBacklog)
+	this.eventLock.Lock()
+	if this.eventsClosed {
+		this.eventLock.Unlock()
+		return
+	}
+	this.eventClients[events] = true
+	this.eventLock.Unlock()
+	defer func() {
+		this.eventLock.Lock()
+		delete(this.eventClients, events)
+		this.eventLock.Unlock()
+	}()
+
+	// Nothing is expected from the client, but reading notices when it goes away
+	gone := make(chan bool)
+	go func() {
+		for {
+			if _, _, err := ws.NextReader(); err != nil {
+				close(gone)
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if ws.WriteJSON(event) != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+	}
+}
+
+// Ends every event stream
+func (this *ApiMgr) closeEvents() {
+	this.eventLock.Lock()
+	defer this.eventLock.Unlock()
+	this.eventsClosed = true
+	for client, _ := range this.eventClients {
+		close(client)
+		delete(this.eventClients, client)
+	}
+}
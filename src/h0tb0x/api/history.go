@@ -0,0 +1,136 @@
+package api
+
+import (
+	"github.com/gorilla/mux"
+	"h0tb0x/data"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// A previous version of a key
+type VersionJson struct {
+	Version     int               `json:"version"`
+	Size        int64             `json:"size"`
+	ContentType string            `json:"contentType,omitempty"`
+	ModTime     string            `json:"modTime,omitempty"`
+	Author      string            `json:"author"`
+	Attrs       map[string]string `json:"attrs"`
+	Replaced    string            `json:"replaced"` // When it stopped being the current value
+}
+
+// How many previous versions of each key a collection keeps
+type RetentionJson struct {
+	Versions int `json:"versions"`
+}
+
+type RestoreJson struct {
+	Key     string `json:"key"`
+	Version int    `json:"version"`
+}
+
+// Lists the previous versions of a key, latest first
+func (this *ApiMgr) getHistory(w http.ResponseWriter, cid string, key string) {
+	out := []VersionJson{}
+	for _, version := range this.GetHistory(cid, key) {
+		rec, err := this.GetVersionRecord(cid, key, version.Version)
+		if err != nil {
+			continue
+		}
+		item := VersionJson{
+			Version:     version.Version,
+			Size:        rec.Size,
+			ContentType: rec.ContentType,
+			Author:      version.Author,
+			Attrs:       rec.Attrs,
+			Replaced:    version.Created.UTC().Format(time.RFC3339),
+		}
+		if rec.ModTime != 0 {
+			item.ModTime = time.Unix(rec.ModTime, 0).UTC().Format(time.RFC3339)
+		}
+		out = append(out, item)
+	}
+	this.sendJson(w, out)
+}
+
+// Sends the data of a previous version of a key
+func (this *ApiMgr) getVersionData(w http.ResponseWriter, req *http.Request, cid string, key string) {
+	version, err := strconv.Atoi(req.URL.Query().Get("version"))
+	if err != nil {
+		this.sendError(w, http.StatusBadRequest, "Invalid version")
+		return
+	}
+	rec, err := this.GetVersionRecord(cid, key, version)
+	if err != nil {
+		this.sendError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	this.sendKept(w, req, rec, func(out io.Writer, wait time.Duration) error {
+		return this.GetVersionData(cid, key, version, out, wait)
+	})
+}
+
+// Sends the data of a value kept besides the current one, get writes it out
+func (this *ApiMgr) sendKept(w http.ResponseWriter, req *http.Request, rec *data.DataRecord,
+	get func(io.Writer, time.Duration) error) {
+	etag := `"` + rec.Digest.String() + `"`
+	w.Header().Set("ETag", etag)
+	setDataHeaders(w, rec)
+	if matchesETag(req.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	// They're only downloaded when asked for
+	err := get(w, data.OnDemandTimeout)
+	if err != nil {
+		this.sendError(w, http.StatusBadRequest, err.Error())
+	}
+}
+
+func (this *ApiMgr) getRetention(w http.ResponseWriter, req *http.Request) {
+	cid := mux.Vars(req)["cid"]
+	if this.GetOwner(cid) == nil || this.IsClosed(cid) {
+		this.sendError(w, http.StatusNotFound, "No such collection")
+		return
+	}
+	this.sendJson(w, RetentionJson{this.GetRetention(cid)})
+}
+
+func (this *ApiMgr) putRetention(w http.ResponseWriter, req *http.Request) {
+	cid := mux.Vars(req)["cid"]
+	var retention RetentionJson
+	if !this.decodeJsonBody(w, req, &retention) {
+		return
+	}
+	err := this.SetRetention(cid, retention.Versions)
+	if err != nil {
+		this.sendError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	this.sendJson(w, retention)
+}
+
+func (this *ApiMgr) restoreData(w http.ResponseWriter, req *http.Request) {
+	cid := mux.Vars(req)["cid"]
+	if this.GetOwner(cid) == nil {
+		this.sendError(w, http.StatusNotFound, "Collection invalid")
+		return
+	}
+	writer := this.GetWriter(cid, this.Ident.Public().Fingerprint().String())
+	if writer == nil {
+		this.sendError(w, http.StatusUnauthorized, "You are not a writer for this collection")
+		return
+	}
+	var restore RestoreJson
+	if !this.decodeJsonBody(w, req, &restore) {
+		return
+	}
+	err := this.Restore(cid, this.Ident, restore.Key, restore.Version)
+	if err != nil {
+		this.sendError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	item, _ := this.collectionItem(cid, restore.Key)
+	this.sendJson(w, item)
+}
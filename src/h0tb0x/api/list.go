@@ -0,0 +1,248 @@
+package api
+
+import (
+	"github.com/gorilla/mux"
+	"h0tb0x/meta"
+	"h0tb0x/sync"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// How many keys a listing returns by default, and at most
+const (
+	DefaultListLimit = 1000
+	MaxListLimit     = 10000
+)
+
+// Adds a prefix match on the key to a query, as a range so it can use the index
+func prefixClause(prefix string, args []interface{}) (string, []interface{}) {
+	if prefix == "" {
+		return "", args
+	}
+	clause := " AND key >= ?"
+	args = append(args, prefix)
+	if end := meta.PrefixEnd(prefix); end != "" {
+		clause += " AND key < ?"
+		args = append(args, end)
+	}
+	return clause, args
+}
+
+// Gets up to limit keys in key order, and the cursor for the next page, empty at the end
+func (this *ApiMgr) keysByKey(cid string, prefix string, after string, limit int) ([]string, string) {
+	it := this.Iterate(cid, prefix)
+	if after != "" {
+		it.Seek(after + "\x00")
+	}
+	keys := []string{}
+	for len(keys) < limit && it.Next() {
+		keys = append(keys, it.Key())
+	}
+	if len(keys) < limit {
+		return keys, ""
+	}
+	return keys, keys[len(keys)-1]
+}
+
+// Gets up to limit keys in the order they were last written, and the cursor for the next page
+func (this *ApiMgr) keysBySeqno(cid string, prefix string, after int64, limit int) ([]string, string) {
+	args := []interface{}{sync.RTData, cid}
+	clause, args := prefixClause(prefix, args)
+	args = append(args, after, limit)
+	rows := this.Db.MultiQuery(`
+		SELECT key, MAX(seqno) AS seq FROM Object
+		WHERE type = ? AND topic = ?`+clause+`
+		GROUP BY key
+		HAVING seq > ?
+		ORDER BY seq
+		LIMIT ?`,
+		args...)
+	keys := []string{}
+	var seq int64
+	for rows.Next() {
+		var key string
+		this.Db.Scan(rows, &key, &seq)
+		keys = append(keys, key)
+	}
+	if len(keys) < limit {
+		return keys, ""
+	}
+	return keys, strconv.FormatInt(seq, 10)
+}
+
+// Gets up to limit entries in key order, rolling keys with delimiter after the prefix up
+// into a single entry for the common prefix, and the cursor for the next page
+func (this *ApiMgr) keysDelimited(cid string, prefix string, delimiter string, after string, limit int) ([]string, string) {
+	it := this.Iterate(cid, prefix)
+	// Resume past everything under a common prefix, or just past a key
+	if after != "" {
+		from := after + "\x00"
+		if strings.HasPrefix(after, prefix) && strings.Contains(after[len(prefix):], delimiter) {
+			from = meta.PrefixEnd(after)
+			if from == "" {
+				return []string{}, ""
+			}
+		}
+		it.Seek(from)
+	}
+	out := []string{}
+	for len(out) < limit && it.Next() {
+		key := it.Key()
+		rest := key[len(prefix):]
+		i := strings.Index(rest, delimiter)
+		if i < 0 {
+			out = append(out, key)
+			continue
+		}
+		common := prefix + rest[:i+len(delimiter)]
+		out = append(out, common)
+		// Nothing else under it is wanted, and no key sorts after one of all 0xff
+		end := meta.PrefixEnd(common)
+		if end == "" {
+			return out, ""
+		}
+		it.Seek(end)
+	}
+	if len(out) < limit {
+		return out, ""
+	}
+	return out, out[len(out)-1]
+}
+
+// Lists a page of the keys of a collection, if there are more, next, and the X-Next header,
+// have the cursor to pass as after to get them.  Deleted keys are skipped, so in seqno order a page may
+// be short.
+// With a delimiter, keys below the next delimiter after the prefix are listed once, as a
+// common prefix, like the directories of a file system.
+func (this *ApiMgr) listData(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	cid := vars["cid"]
+	query := req.URL.Query()
+	limit := DefaultListLimit
+	if str := query.Get("limit"); str != "" {
+		n, err := strconv.Atoi(str)
+		if err != nil || n <= 0 {
+			this.sendError(w, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+		if n < MaxListLimit {
+			limit = n
+		} else {
+			limit = MaxListLimit
+		}
+	}
+	prefix := query.Get("prefix")
+	after := query.Get("after")
+
+	delimiter := query.Get("delimiter")
+
+	var keys []string
+	var next string
+	switch query.Get("order") {
+	case "", "key":
+		if delimiter != "" {
+			keys, next = this.keysDelimited(cid, prefix, delimiter, after, limit)
+		} else {
+			keys, next = this.keysByKey(cid, prefix, after, limit)
+		}
+	case "seqno":
+		if delimiter != "" {
+			this.sendError(w, http.StatusBadRequest, "Delimiter requires key order")
+			return
+		}
+		seq := int64(0)
+		if after != "" {
+			var err error
+			seq, err = strconv.ParseInt(after, 10, 64)
+			if err != nil {
+				this.sendError(w, http.StatusBadRequest, "Invalid after")
+				return
+			}
+		}
+		keys, next = this.keysBySeqno(cid, prefix, seq, limit)
+	default:
+		this.sendError(w, http.StatusBadRequest, "Invalid order")
+		return
+	}
+
+	out := []CollectionItemJson{}
+	for _, key := range keys {
+		if delimiter != "" && strings.Contains(key[len(prefix):], delimiter) {
+			out = append(out, CollectionItemJson{Key: key, Prefix: true})
+			continue
+		}
+		// Skip deleted keys
+		item, ok := this.collectionItem(cid, key)
+		if ok {
+			out = append(out, item)
+		}
+	}
+	if next != "" {
+		w.Header().Set("X-Next", next)
+	}
+	this.sendJson(w, ListJson{Items: out, Next: next})
+}
+
+func (this *ApiMgr) deletePrefix(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	cid := vars["cid"]
+	if this.GetOwner(cid) == nil {
+		this.sendError(w, http.StatusNotFound, "Collection invalid")
+		return
+	}
+	writer := this.GetWriter(cid, this.Ident.Public().Fingerprint().String())
+	if writer == nil {
+		this.sendError(w, http.StatusUnauthorized, "You are not a writer for this collection")
+		return
+	}
+	// Deleting everything by mistake would be too easy
+	prefix := req.URL.Query().Get("prefix")
+	if prefix == "" {
+		this.sendError(w, http.StatusBadRequest, "A prefix is required")
+		return
+	}
+	count, err := this.DeletePrefix(cid, this.Ident, prefix)
+	if err != nil {
+		this.sendError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	this.sendJson(w, CountJson{count})
+}
+
+func (this *ApiMgr) renameData(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	cid := vars["cid"]
+	if this.GetOwner(cid) == nil {
+		this.sendError(w, http.StatusNotFound, "Collection invalid")
+		return
+	}
+	writer := this.GetWriter(cid, this.Ident.Public().Fingerprint().String())
+	if writer == nil {
+		this.sendError(w, http.StatusUnauthorized, "You are not a writer for this collection")
+		return
+	}
+	var rename RenameJson
+	if !this.decodeJsonBody(w, req, &rename) {
+		return
+	}
+	if rename.From == "" || rename.To == "" {
+		this.sendError(w, http.StatusBadRequest, "Both from and to are required")
+		return
+	}
+	if !rename.Recursive {
+		err := this.Rename(cid, this.Ident, rename.From, rename.To)
+		if err != nil {
+			this.sendError(w, http.StatusConflict, err.Error())
+			return
+		}
+		this.sendJson(w, CountJson{1})
+		return
+	}
+	count, err := this.RenamePrefix(cid, this.Ident, rename.From, rename.To)
+	if err != nil {
+		this.sendError(w, http.StatusConflict, err.Error())
+		return
+	}
+	this.sendJson(w, CountJson{count})
+}
@@ -0,0 +1,29 @@
+package api
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+)
+
+// Gets the fingerprint of the public key of a certificate, in the form curl's --pinnedpubkey
+// takes.  Unlike a hash of the whole certificate, it stays the same when the certificate is
+// made again from the same key, as the one from the node identity is on every start.
+func TlsFingerprint(cert *tls.Certificate) (string, error) {
+	if len(cert.Certificate) == 0 {
+		return "", fmt.Errorf("Unable to fingerprint certificate, it's empty")
+	}
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return "", err
+	}
+	return SpkiFingerprint(parsed), nil
+}
+
+// Gets the fingerprint of the public key of a parsed certificate, as for TlsFingerprint
+func SpkiFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256//" + base64.StdEncoding.EncodeToString(sum[:])
+}
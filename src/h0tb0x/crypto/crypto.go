@@ -6,6 +6,7 @@ import (
 	"crypto"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
@@ -101,6 +102,8 @@ type Crypter interface {
 	Process(in []byte) (out []byte)
 	// Finalize gets any final output bytes
 	Finalize() (out []byte)
+	// Valid reports if the stream was authentic, only meaningful after Finalize
+	Valid() bool
 }
 
 // PublicIdentity represents the public part of an identity
@@ -117,13 +120,8 @@ type SecretIdentity struct {
 
 // SymmetricKey represents a shared or session secret.
 // It cannot be transfered, only encrypted versions may be serialized.
-// Currently, no methods, but someday it will include Encrypt, Decrypt, Sign, and Verify
 type SymmetricKey struct {
 	key []byte
-	//Encrypt() (io Crypter)  // IV is placed in cypter stream as first bytes
-	//Decrypt() (io Crypter)  // Expects IV as first byte
-	//Sign(hash *Digest) (signature *SKSignature)
-	//Verify(hash *Digest, signature *SKSignature) (valid bool)
 }
 
 type implHasher struct {
@@ -143,6 +141,177 @@ func NewHasher() Hasher {
 	return &implHasher{impl: sha256.New224()}
 }
 
+// Encrypted streams are laid out as IV, then ciphertext, then a MAC of both
+const (
+	ivSize  = aes.BlockSize
+	macSize = sha256.Size224
+)
+
+type encrypter struct {
+	stream cipher.Stream
+	mac    hash.Hash
+	iv     []byte // The IV, until it has been output
+}
+
+func (this *encrypter) Process(in []byte) []byte {
+	out := make([]byte, len(this.iv)+len(in))
+	copy(out, this.iv)
+	this.stream.XORKeyStream(out[len(this.iv):], in)
+	this.mac.Write(out)
+	this.iv = nil
+	return out
+}
+
+func (this *encrypter) Finalize() []byte {
+	out := this.Process(nil) // Make sure the IV goes out even if no data did
+	return append(out, this.mac.Sum(nil)...)
+}
+
+func (this *encrypter) Valid() bool {
+	return true
+}
+
+type decrypter struct {
+	block  cipher.Block
+	stream cipher.Stream // Nil until the whole IV has arrived
+	mac    hash.Hash
+	buf    []byte // Partial IV, or the trailing bytes which may be the MAC
+	valid  bool
+}
+
+func (this *decrypter) Process(in []byte) []byte {
+	this.buf = append(this.buf, in...)
+	if this.stream == nil {
+		if len(this.buf) < ivSize {
+			return nil
+		}
+		iv := this.buf[:ivSize]
+		this.mac.Write(iv)
+		this.stream = cipher.NewCTR(this.block, iv)
+		this.buf = this.buf[ivSize:]
+	}
+	// Always hold back enough bytes to be the MAC, since I can't tell where the end is
+	n := len(this.buf) - macSize
+	if n <= 0 {
+		return nil
+	}
+	out := make([]byte, n)
+	this.mac.Write(this.buf[:n])
+	this.stream.XORKeyStream(out, this.buf[:n])
+	this.buf = append([]byte{}, this.buf[n:]...)
+	return out
+}
+
+func (this *decrypter) Finalize() []byte {
+	this.valid = this.stream != nil && len(this.buf) == macSize &&
+		hmac.Equal(this.mac.Sum(nil), this.buf)
+	return nil
+}
+
+func (this *decrypter) Valid() bool {
+	return this.valid
+}
+
+// Derives a sub-key for a specific purpose, so no two algorithms share a key
+func (this *SymmetricKey) derive(purpose string) []byte {
+	mac := hmac.New(sha256.New224, this.key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func (this *SymmetricKey) newCipher() cipher.Block {
+	block, err := aes.NewCipher(this.derive("encrypt")[:16])
+	if err != nil {
+		panic(err)
+	}
+	return block
+}
+
+// Makes a Crypter which encrypts, the IV is placed in the crypter stream as the first bytes,
+// and a MAC covering the whole stream is output by Finalize
+func (this *SymmetricKey) Encrypt() Crypter {
+	iv := make([]byte, ivSize)
+	_, err := io.ReadFull(rand.Reader, iv)
+	if err != nil {
+		panic(err)
+	}
+	return &encrypter{
+		stream: cipher.NewCTR(this.newCipher(), iv),
+		mac:    hmac.New(sha256.New224, this.derive("stream")),
+		iv:     iv,
+	}
+}
+
+// Makes a Crypter which decrypts, expects the IV as the first bytes of the stream.
+// Plaintext is returned as it is decrypted, so nothing should be trusted until
+// Finalize has been called and Valid returns true.
+func (this *SymmetricKey) Decrypt() Crypter {
+	return &decrypter{
+		block: this.newCipher(),
+		mac:   hmac.New(sha256.New224, this.derive("stream")),
+	}
+}
+
+// Encrypts a whole buffer at once
+func (this *SymmetricKey) EncryptBytes(in []byte) []byte {
+	enc := this.Encrypt()
+	return append(enc.Process(in), enc.Finalize()...)
+}
+
+// Decrypts a whole buffer at once, fails if the data isn't authentic
+func (this *SymmetricKey) DecryptBytes(in []byte) ([]byte, error) {
+	dec := this.Decrypt()
+	out := dec.Process(in)
+	dec.Finalize()
+	if !dec.Valid() {
+		return nil, fmt.Errorf("Decryption failed, data is not authentic")
+	}
+	return out, nil
+}
+
+// CryptWriter runs everything written to it through a Crypter before passing it on
+type CryptWriter struct {
+	out     io.Writer
+	crypter Crypter
+}
+
+// Makes a new CryptWriter, which must be closed to flush the final bytes
+func NewCryptWriter(out io.Writer, crypter Crypter) *CryptWriter {
+	return &CryptWriter{out: out, crypter: crypter}
+}
+
+func (this *CryptWriter) Write(p []byte) (int, error) {
+	_, err := this.out.Write(this.crypter.Process(p))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Writes any final bytes, and returns an error if the stream wasn't authentic
+func (this *CryptWriter) Close() error {
+	_, err := this.out.Write(this.crypter.Finalize())
+	if err != nil {
+		return err
+	}
+	if !this.crypter.Valid() {
+		return fmt.Errorf("Decryption failed, data is not authentic")
+	}
+	return nil
+}
+
+// Computes a keyed MAC of a digest
+func (this *SymmetricKey) Sign(digest *Digest) (signature *SKSignature) {
+	mac := hmac.New(sha256.New224, this.derive("sign"))
+	mac.Write(digest.impl)
+	return &SKSignature{impl: mac.Sum(nil)}
+}
+
+// Verifies that signature is the MAC of digest by this key
+func (this *SymmetricKey) Verify(digest *Digest, signature *SKSignature) (valid bool) {
+	return hmac.Equal(this.Sign(digest).impl, signature.impl)
+}
+
 // Encrypts a symmetric key to this identity
 func (this *PublicIdentity) Encrypt(key *SymmetricKey) (ek *EncryptedKey) {
 	out, err := rsa.EncryptOAEP(sha256.New224(), rand.Reader, this.key, key.key, nil)
@@ -113,3 +113,76 @@ func TestIdent(t *testing.T) {
 		t.Fatal("Good signature failed")
 	}
 }
+
+func TestSymmetric(t *testing.T) {
+	key := NewSymmetricKey()
+	plain := []byte("The quick brown fox jumps over the lazy dog")
+	enc := key.Encrypt()
+	var cipher []byte
+	cipher = append(cipher, enc.Process(plain[:10])...)
+	cipher = append(cipher, enc.Process(plain[10:])...)
+	cipher = append(cipher, enc.Finalize()...)
+	if len(cipher) != ivSize+len(plain)+macSize {
+		t.Fatalf("Unexpected ciphertext size: %d", len(cipher))
+	}
+	// Decrypt with different chunking than was used to encrypt
+	dec := key.Decrypt()
+	var out []byte
+	for i := 0; i < len(cipher); i += 7 {
+		end := i + 7
+		if end > len(cipher) {
+			end = len(cipher)
+		}
+		out = append(out, dec.Process(cipher[i:end])...)
+	}
+	out = append(out, dec.Finalize()...)
+	if !dec.Valid() {
+		t.Fatal("Good stream failed to authenticate")
+	}
+	if string(out) != string(plain) {
+		t.Fatalf("Round trip failed, got: %q", out)
+	}
+	cipher[ivSize+3] ^= 1
+	dec = key.Decrypt()
+	dec.Process(cipher)
+	dec.Finalize()
+	if dec.Valid() {
+		t.Fatal("Tampered stream authenticated")
+	}
+	cipher[ivSize+3] ^= 1
+	dec = NewSymmetricKey().Decrypt()
+	dec.Process(cipher)
+	dec.Finalize()
+	if dec.Valid() {
+		t.Fatal("Stream authenticated with the wrong key")
+	}
+	dec = key.Decrypt()
+	dec.Process(cipher[:ivSize+macSize-1])
+	dec.Finalize()
+	if dec.Valid() {
+		t.Fatal("Truncated stream authenticated")
+	}
+
+	hasher := NewHasher()
+	hasher.Write([]byte("Hello world"))
+	digest := hasher.Finalize()
+	sig := key.Sign(digest)
+	sigs, err := transfer.EncodeString(sig)
+	if err != nil {
+		t.Fatalf("Unable to encode signature: %s", err)
+	}
+	var sig2 *SKSignature
+	err = transfer.DecodeString(sigs, &sig2)
+	if err != nil {
+		t.Fatalf("Unable to decode signature: %s", err)
+	}
+	if !key.Verify(digest, sig2) {
+		t.Fatal("Good MAC failed")
+	}
+	if NewSymmetricKey().Verify(digest, sig2) {
+		t.Fatal("MAC verified with the wrong key")
+	}
+	if key.Verify(HashOf("Goodbye world"), sig2) {
+		t.Fatal("MAC verified for the wrong digest")
+	}
+}
@@ -31,18 +31,49 @@ type DataObj struct {
 	State       int            // What is my current state
 	Downloading bool           // Am I downloading?
 	Tracking    map[string]int // For each topic, how many object in that topic use this
+	// Stored in their own columns, so storage can be managed in SQL
+	size     int64 // Bytes on disk, 0 if not local
+	used     int64 // Unix time of the last use
+	authored bool  // Was it put locally, if so it's never evicted
+	pinned   bool  // Is a key using it pinned, if so it's never evicted
+	evicted  bool  // Was it evicted, if so it's only downloaded on demand
+	wanted   bool  // Has someone asked for it, if so it's downloaded whatever the policy
 }
 
+type DownloadStatus int
+
+const (
+	DownloadStarted  DownloadStatus = iota // Sent when a download starts
+	DownloadFinished                       // Sent when a download finishes, and the blob is local
+	DownloadFailed                         // Sent when a download fails, it's retried later
+)
+
+// Called with the lock held, so it must not call back into the DataMgr
+type DownloadListenerFunc func(key string, what DownloadStatus, err error)
+
+// How many blobs are downloaded at once by default
+const DefaultMaxDownloads = 4
+
+// How long a get of on demand data waits for the download to make progress
+const OnDemandTimeout = time.Minute
+
 // The DataMgr
 type DataMgr struct {
 	*meta.MetaMgr
-	rand       *rand.Rand
-	dir        string
-	incoming   string
-	lock       gosync.Locker
-	download   gosync.Cond
-	goRoutines gosync.WaitGroup
-	isClosing  bool
+	MaxDownloads int   // How many blobs to download at once, set before Start
+	Quota        int64 // Bytes of blobs to keep locally, 0 for no limit, set before Start
+	rand         *rand.Rand
+	dir          string
+	incoming     string
+	lock         gosync.Locker
+	download     gosync.Cond
+	fetched      gosync.Cond // Signaled whenever a download finishes
+	goRoutines   gosync.WaitGroup
+	isClosing    bool
+	active       int   // How many downloads are running
+	evictions    int   // How many blobs were evicted since startup
+	evictedBytes int64 // How many bytes were evicted since startup
+	listeners    []DownloadListenerFunc
 }
 
 // Add 'incoming advert'
@@ -97,9 +128,12 @@ func (this *DataMgr) advertize(topic string, key string, up bool) {
 // Return a deserialized object, or nil if none
 func (this *DataMgr) maybeGetObj(key string) *DataObj {
 	//this.Log.Printf("Getting Object: %s", key)
-	row := this.Db.SingleQuery("SELECT data FROM Blob WHERE key=?", key)
+	row := this.Db.SingleQuery(
+		"SELECT data, size, used, authored, pinned, evicted, wanted FROM Blob WHERE key=?", key)
 	var data []byte
-	if this.Db.MaybeScan(row, &data) {
+	var size, used int64
+	var authored, pinned, evicted, wanted bool
+	if this.Db.MaybeScan(row, &data, &size, &used, &authored, &pinned, &evicted, &wanted) {
 		var obj *DataObj
 		//this.Log.Printf("Found Object: %s, data = %v", key, data)
 		err := transfer.DecodeBytes(data, &obj)
@@ -107,6 +141,12 @@ func (this *DataMgr) maybeGetObj(key string) *DataObj {
 			panic(err)
 		}
 		obj.mgr = this
+		obj.size = size
+		obj.used = used
+		obj.authored = authored
+		obj.pinned = pinned
+		obj.evicted = evicted
+		obj.wanted = wanted
 		return obj
 	}
 	return nil
@@ -134,7 +174,11 @@ func (this *DataMgr) writeObj(obj *DataObj) {
 			name := path.Join(this.dir, obj.Key)
 			os.Remove(name)
 		}
+		// Drop any partial download
+		os.Remove(path.Join(this.incoming, obj.Key))
 		//this.Log.Printf("Deleting")
+		this.Db.Exec("DELETE FROM Manifest WHERE key = ?", obj.Key)
+		this.Db.Exec("DELETE FROM Chunk WHERE key = ?", obj.Key)
 		this.Db.Exec("DELETE FROM Blob WHERE Key = ?", obj.Key)
 	} else {
 		//this.Log.Printf("Deleting and Storing")
@@ -144,8 +188,14 @@ func (this *DataMgr) writeObj(obj *DataObj) {
 			panic(err)
 		}
 		//this.Log.Printf("Putting data as: %v", data)
-		this.Db.Exec("INSERT INTO Blob (key, needs_download, data) VALUES (?, ?, ?)",
-			obj.Key, obj.State == DSReady && !obj.Downloading, data)
+		eager, pinned := this.refPolicy(obj.Key)
+		obj.pinned = pinned
+		needed := obj.wanted || (eager && !obj.evicted)
+		this.Db.Exec(`
+			INSERT INTO Blob (key, needs_download, data, size, used, authored, pinned, evicted, wanted)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			obj.Key, obj.State == DSReady && !obj.Downloading && needed, data,
+			obj.size, obj.used, obj.authored, obj.pinned, obj.evicted, obj.wanted)
 	}
 }
 
@@ -194,32 +244,83 @@ func (this *DataObj) metaDown(topic string) {
 }
 
 func (this *DataMgr) onMeta(topic string, key string, data []byte, fp string, isUp bool) {
-	var objHash *crypto.Digest
-	err := transfer.DecodeBytes(data, &objHash)
+	rec, err := decodeRecord(data)
 	if err != nil {
 		this.Log.Printf("Unable to decode meta-data value")
 		return
 	}
-	objKey := objHash.String()
+	objKey := rec.Digest.String()
 	this.lock.Lock()
 	defer this.lock.Unlock()
 	obj := this.getObj(objKey)
 	if isUp {
+		this.addRef(topic, key, objKey)
 		obj.metaUp(topic)
 	} else {
+		this.delRef(topic, key, objKey)
 		obj.metaDown(topic)
 	}
 	this.writeObj(obj)
 }
 
+// Holds the blobs of values the meta-data layer keeps besides the current ones, previous
+// versions and conflicting siblings.  There's no ref, so they're kept if local, but only
+// downloaded if asked for.
+func (this *DataMgr) onKept(topic string, key string, data []byte, fp string, isUp bool) {
+	rec, err := decodeRecord(data)
+	if err != nil {
+		this.Log.Printf("Unable to decode meta-data value")
+		return
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	obj := this.getObj(rec.Digest.String())
+	if isUp {
+		obj.metaUp(topic)
+	} else {
+		obj.metaDown(topic)
+	}
+	this.writeObj(obj)
+}
+
+// Drops the incoming adverts of a closed collection, the meta-data layer has already
+// dropped the tracking, so blobs used only by that collection are gone
+func (this *DataMgr) onClose(topic string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	rows := this.Db.MultiQuery("SELECT DISTINCT key FROM Advert WHERE topic = ?", topic)
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		this.Db.Scan(rows, &key)
+		keys = append(keys, key)
+	}
+	this.Db.Exec("DELETE FROM Advert WHERE topic = ?", topic)
+	this.Db.Exec("DELETE FROM Pin WHERE topic = ?", topic)
+	for _, key := range keys {
+		obj := this.maybeGetObj(key)
+		if obj != nil && obj.State == DSReady && !this.anyAdverts(key) {
+			obj.State = DSNotReady
+			this.writeObj(obj)
+		}
+	}
+}
+
 func (this *DataObj) newFile(file string) {
 	if this.State == DSLocal {
+		os.Remove(file)
 		return
 	}
 	newname := path.Join(this.mgr.dir, this.Key)
 	os.Rename(file, newname)
 	this.mgr.Log.Printf("Setting state of %s to Local", this.Key)
 	this.State = DSLocal
+	this.evicted = false
+	this.wanted = false
+	this.used = time.Now().Unix()
+	if info, err := os.Stat(newname); err == nil {
+		this.size = info.Size()
+	}
 	for topic, _ := range this.Tracking {
 		this.mgr.advertize(topic, this.Key, true)
 	}
@@ -230,13 +331,12 @@ func (this *DataObj) startDownload() {
 	this.Downloading = true
 }
 
-func (this *DataObj) finishDownload(file string, worked bool) {
+// Ends a download, file is the complete blob, or "" if the download didn't finish
+func (this *DataObj) finishDownload(file string) {
 	this.Downloading = false
 	this.Holds--
-	if worked {
+	if file != "" {
 		this.newFile(file)
-	} else {
-		os.Remove(file)
 	}
 }
 
@@ -248,20 +348,38 @@ func NewDataMgr(dir string, themeta *meta.MetaMgr) *DataMgr {
 		panic(err)
 	}
 	dm := &DataMgr{
-		MetaMgr:  themeta,
-		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
-		dir:      dir,
-		incoming: incoming,
-		lock:     base.NewNoisyLocker(themeta.Log.Prefix() + "data "),
+		MetaMgr:      themeta,
+		MaxDownloads: DefaultMaxDownloads,
+		rand:         rand.New(rand.NewSource(time.Now().UnixNano())),
+		dir:          dir,
+		incoming:     incoming,
+		lock:         base.NewNoisyLocker(themeta.Log.Prefix() + "data "),
 	}
 	dm.download.L = dm.lock
+	dm.fetched.L = dm.lock
 	dm.SetSink(sync.RTAdvert, dm.onAdvert)
 	dm.AddHandler(link.ServiceData, dm.onDataGet)
 	dm.AddCallback(dm.onMeta)
+	dm.AddHistoryCallback(dm.onKept)
+	dm.AddConflictCallback(dm.onKept)
+	dm.AddCloseCallback(dm.onClose)
+	dm.AddListener(dm.onFriendChange)
 	return dm
 }
 
+// Add a listener to get download notifications
+func (this *DataMgr) AddDownloadListener(listener DownloadListenerFunc) {
+	this.listeners = append(this.listeners, listener)
+}
+
+func (this *DataMgr) signalDownload(key string, what DownloadStatus, err error) {
+	for _, onListener := range this.listeners {
+		onListener(key, what, err)
+	}
+}
+
 func (this *DataMgr) Start() {
+	this.recoverObjs()
 	this.MetaMgr.Start()
 	this.goRoutines.Add(1)
 	go this.downloadLoop()
@@ -271,11 +389,42 @@ func (this *DataMgr) Stop() {
 	this.lock.Lock()
 	this.isClosing = true
 	this.download.Broadcast()
+	this.fetched.Broadcast()
 	this.lock.Unlock()
 	this.goRoutines.Wait()
 	this.MetaMgr.Stop()
 }
 
+// Clears holds and downloads left over from a crash, partial downloads are kept so they resume
+func (this *DataMgr) recoverObjs() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.fillRefs()
+	rows := this.Db.MultiQuery("SELECT key FROM Blob")
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		this.Db.Scan(rows, &key)
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		obj := this.getObj(key)
+		if obj.Holds != 0 || obj.Downloading {
+			obj.Holds = 0
+			obj.Downloading = false
+			this.writeObj(obj)
+		}
+		// Blobs from before sizes were tracked
+		if obj.State == DSLocal && obj.size == 0 {
+			if info, err := os.Stat(path.Join(this.dir, key)); err == nil && info.Size() > 0 {
+				obj.size = info.Size()
+				this.writeObj(obj)
+			}
+		}
+	}
+	this.enforceQuota()
+}
+
 func (this *DataMgr) onDataGet(who int, ident *crypto.Digest, in io.Reader, out io.Writer) error {
 	// TODO: Fix security hole where people can determine which blobs I have
 	var key string
@@ -283,6 +432,12 @@ func (this *DataMgr) onDataGet(who int, ident *crypto.Digest, in io.Reader, out
 	if err != nil {
 		return err
 	}
+	// Older clients only send the key, and get the whole blob
+	chunk := chunkAll
+	var reqChunk int
+	if transfer.Decode(in, &reqChunk) == nil {
+		chunk = reqChunk
+	}
 
 	this.lock.Lock()
 	obj := this.maybeGetObj(key)
@@ -292,13 +447,10 @@ func (this *DataMgr) onDataGet(who int, ident *crypto.Digest, in io.Reader, out
 	}
 	obj.Holds++
 	this.writeObj(obj)
+	manifest := this.getManifest(key)
 	this.lock.Unlock()
 
-	name := path.Join(this.dir, key)
-	file, err := os.Open(name)
-	if err == nil {
-		_, err = io.Copy(out, file)
-	}
+	err = this.serveData(key, chunk, manifest, out)
 
 	this.lock.Lock()
 	obj = this.getObj(key)
@@ -309,15 +461,245 @@ func (this *DataMgr) onDataGet(who int, ident *crypto.Digest, in io.Reader, out
 	return err
 }
 
+// Sends the manifest, a chunk, or all of a local blob
+func (this *DataMgr) serveData(key string, chunk int, manifest *Manifest, out io.Writer) error {
+	if chunk == chunkManifest {
+		err := transfer.Encode(out, manifest != nil)
+		if err == nil && manifest != nil {
+			err = transfer.Encode(out, manifest)
+		}
+		return err
+	}
+	if chunk != chunkAll && (manifest == nil || chunk < 0 || chunk >= len(manifest.Chunks)) {
+		return fmt.Errorf("Unknown chunk %d of blob: %s", chunk, key)
+	}
+	file, err := os.Open(path.Join(this.dir, key))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if chunk == chunkAll {
+		_, err = io.Copy(out, file)
+		return err
+	}
+	offset, size := manifest.chunkRange(chunk)
+	_, err = file.Seek(offset, 0)
+	if err == nil {
+		_, err = io.CopyN(out, file, size)
+	}
+	return err
+}
+
+func (this *DataMgr) closing() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.isClosing
+}
+
+// Gets the manifest of a blob from a friend, nil if it's a legacy blob without one
+func (this *DataMgr) fetchManifest(key string, friend int) (*Manifest, error) {
+	var send_buf, recv_buf bytes.Buffer
+	transfer.Encode(&send_buf, key, chunkManifest)
+	err := this.Send(link.ServiceData, friend, &send_buf, &recv_buf)
+	if err != nil {
+		return nil, err
+	}
+	var chunked bool
+	err = transfer.Decode(&recv_buf, &chunked)
+	if err != nil || !chunked {
+		return nil, err
+	}
+	var manifest *Manifest
+	err = transfer.Decode(&recv_buf, &manifest)
+	if err != nil {
+		return nil, err
+	}
+	if !manifest.valid() || manifest.key() != key {
+		return nil, &badDataError{key}
+	}
+	return manifest, nil
+}
+
+// Gets one chunk from a friend, verifies it, and writes it into place
+func (this *DataMgr) fetchChunk(file *os.File, key string, friend int, manifest *Manifest, idx int) error {
+	var send_buf, recv_buf bytes.Buffer
+	transfer.Encode(&send_buf, key, idx)
+	err := this.Send(link.ServiceData, friend, &send_buf, &recv_buf)
+	if err != nil {
+		return err
+	}
+	offset, size := manifest.chunkRange(idx)
+	hasher := crypto.NewHasher()
+	hasher.Write(recv_buf.Bytes())
+	if int64(recv_buf.Len()) != size || !hasher.Finalize().Equal(manifest.Chunks[idx]) {
+		return &badDataError{key}
+	}
+	_, err = file.WriteAt(recv_buf.Bytes(), offset)
+	return err
+}
+
+// Gets a legacy blob from a friend in one go, the key of legacy blobs is the hash of the data
+func (this *DataMgr) fetchWhole(key string, friend int) (string, error) {
+	var send_buf bytes.Buffer
+	transfer.Encode(&send_buf, key, chunkAll)
+	tmppath := path.Join(this.incoming, crypto.RandomString())
+	file, err := os.Create(tmppath)
+	if err != nil {
+		return "", err
+	}
+	hasher := crypto.NewHasher()
+	both := io.MultiWriter(file, hasher)
+	err = this.Send(link.ServiceData, friend, &send_buf, both)
+	file.Close()
+	if err == nil && hasher.Finalize().String() != key {
+		err = &badDataError{key}
+	}
+	if err != nil {
+		os.Remove(tmppath)
+		return "", err
+	}
+	return tmppath, nil
+}
+
+// Downloads whatever I'm missing of a blob from the friends advertising it.  Each friend
+// gets a worker which pulls chunks from a shared queue, so faster friends do more of
+// the work.  Chunks are stored in incoming as they arrive, so an interrupted download
+// picks up where it left off.  Returns the path of the complete blob.
+func (this *DataMgr) fetchBlob(key string, friends []int) (string, error) {
+	this.lock.Lock()
+	manifest := this.getManifest(key)
+	this.lock.Unlock()
+	if manifest == nil {
+		var err error
+		var file string
+		manifest, err = this.fetchManifest(key, friends[0])
+		if err == nil && manifest == nil {
+			file, err = this.fetchWhole(key, friends[0])
+		}
+		if err != nil || manifest == nil {
+			this.lock.Lock()
+			this.checkBadData(friends[0], err)
+			this.lock.Unlock()
+			return file, err
+		}
+		this.lock.Lock()
+		this.putManifest(key, manifest)
+		this.fetched.Broadcast()
+		this.lock.Unlock()
+	}
+
+	partial := path.Join(this.incoming, key)
+	file, err := os.OpenFile(partial, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	this.lock.Lock()
+	have := this.haveChunks(key)
+	this.lock.Unlock()
+	queue := make(chan int, len(manifest.Chunks))
+	for idx := range manifest.Chunks {
+		if !have[idx] {
+			queue <- idx
+		}
+	}
+	close(queue)
+
+	// A worker gives up on its first failure, the chunk is retried on the next attempt
+	var workers gosync.WaitGroup
+	var lastErr error
+	for _, friend := range friends {
+		workers.Add(1)
+		go func(friend int) {
+			defer workers.Done()
+			for idx := range queue {
+				if this.closing() {
+					return
+				}
+				err := this.fetchChunk(file, key, friend, manifest, idx)
+				this.lock.Lock()
+				if err != nil {
+					this.Log.Printf("Chunk %d of %s from %d failed: %s", idx, key, friend, err)
+					this.checkBadData(friend, err)
+					lastErr = err
+					this.lock.Unlock()
+					return
+				}
+				this.Db.Exec("INSERT OR IGNORE INTO Chunk (key, idx) VALUES (?, ?)", key, idx)
+				this.fetched.Broadcast()
+				this.lock.Unlock()
+			}
+		}(friend)
+	}
+	workers.Wait()
+
+	this.lock.Lock()
+	missing := len(manifest.Chunks) - len(this.haveChunks(key))
+	this.lock.Unlock()
+	if missing > 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("Download of %s stopped with %d chunks missing", key, missing)
+		}
+		return "", lastErr
+	}
+	err = file.Truncate(manifest.Size)
+	if err != nil {
+		return "", err
+	}
+	return partial, nil
+}
+
+// Downloads a blob, and marks it as done.  Called without the lock.
+func (this *DataMgr) runDownload(key string, friends []int) {
+	this.Log.Printf("Doing a download of %s from %v!\n", key, friends)
+	tryTime := time.Now()
+	file, err := this.fetchBlob(key, friends)
+	if err != nil && time.Now().Sub(tryTime) < 5*time.Second && !this.closing() {
+		// TODO: Make this not suck
+		time.Sleep(5 * time.Second)
+	}
+	if err != nil {
+		this.Log.Printf("Download failed: %s", err)
+	} else {
+		this.Log.Printf("Download worked!")
+	}
+	this.lock.Lock()
+	obj := this.getObj(key)
+	if err == nil {
+		this.Db.Exec("DELETE FROM Chunk WHERE key = ?", key)
+	}
+	obj.finishDownload(file)
+	this.writeObj(obj)
+	if err == nil {
+		this.signalDownload(key, DownloadFinished, nil)
+	} else {
+		this.signalDownload(key, DownloadFailed, err)
+	}
+	this.enforceQuota()
+	this.active--
+	this.download.Broadcast()
+	this.fetched.Broadcast()
+	this.lock.Unlock()
+	this.goRoutines.Done()
+}
+
+// Starts downloads of blobs which need them, up to MaxDownloads at once
 func (this *DataMgr) downloadLoop() {
 	this.Log.Printf("Entering download loop")
-	this.lock.Lock() // Lock is held *except* when doing remote calls & sleeping
+	this.lock.Lock() // Lock is held *except* when sleeping
 	// While I'm not closing
 	for !this.isClosing {
+		if this.active >= this.MaxDownloads {
+			this.download.Wait()
+			continue
+		}
 		this.SyncMgr.Log.Printf("Looking for things to download\n")
 		// Get a object to download
 		var key string
-		row := this.Db.SingleQuery("SELECT key FROM Blob WHERE needs_download = 1")
+		// Things someone is waiting for go first
+		row := this.Db.SingleQuery(
+			"SELECT key FROM Blob WHERE needs_download = 1 ORDER BY wanted DESC LIMIT 1")
 		if !this.Db.MaybeScan(row, &key) {
 			this.Log.Printf("Nothing to download, sleeping\n")
 			this.download.Wait()
@@ -329,35 +711,20 @@ func (this *DataMgr) downloadLoop() {
 			this.Db.Exec("UPDATE Blob SET needs_download = 0 WHERE key = ?", key)
 			continue
 		}
-		friend := friends[rand.Intn(len(friends))]
+		// Shuffle, so the manifest comes from a random friend, then put trusted friends first
+		order := this.rand.Perm(len(friends))
+		shuffled := make([]int, len(friends))
+		for i, j := range order {
+			shuffled[i] = friends[j]
+		}
+		shuffled = this.rankFriends(shuffled)
 		obj := this.getObj(key)
 		obj.startDownload()
 		this.writeObj(obj)
-		this.lock.Unlock()
-		this.Log.Printf("Doing a download of %s from %d!\n", key, friend)
-
-		var send_buf bytes.Buffer
-		transfer.Encode(&send_buf, key)
-		tmppath := path.Join(this.incoming, crypto.RandomString())
-		file, _ := os.Create(tmppath)
-		hasher := crypto.NewHasher()
-		both := io.MultiWriter(file, hasher)
-
-		tryTime := time.Now()
-		err := this.Send(link.ServiceData, friend, &send_buf, both)
-		if err != nil && time.Now().Sub(tryTime) < 5*time.Second {
-			// TODO: Make this not suck
-			time.Sleep(5 * time.Second)
-		}
-		if err != nil {
-			this.Log.Printf("Download failed: %s", err)
-		} else {
-			this.Log.Printf("Download worked!")
-		}
-		this.lock.Lock()
-		obj = this.getObj(key)
-		obj.finishDownload(tmppath, err == nil)
-		this.writeObj(obj)
+		this.signalDownload(key, DownloadStarted, nil)
+		this.active++
+		this.goRoutines.Add(1)
+		go this.runDownload(key, shuffled)
 	}
 	this.lock.Unlock()
 	this.goRoutines.Done()
@@ -365,34 +732,59 @@ func (this *DataMgr) downloadLoop() {
 
 // Reads from io.Reader and generates a new object, put it to the meta-data layer
 func (this *DataMgr) PutData(topic string, key string, writer *crypto.SecretIdentity, stream io.Reader) error {
+	return this.PutDataRecord(topic, key, writer, stream, &DataRecord{})
+}
+
+// Puts data along with a record describing it, the content type and attributes come from
+// the record passed in, the rest is filled in
+func (this *DataMgr) PutDataRecord(topic string, key string, writer *crypto.SecretIdentity, stream io.Reader, rec *DataRecord) error {
 	this.Log.Printf("Putting data: %s, %s", topic, key)
+	var size byteCounter
+	stream = io.TeeReader(stream, &size)
 	// Write the object to disk
 	tmppath := path.Join(this.incoming, crypto.RandomString())
 	file, err := os.Create(tmppath)
 	if err != nil {
 		return err
 	}
-	hasher := crypto.NewHasher()
-	both := io.MultiWriter(file, hasher)
-	_, err = io.Copy(both, stream)
+	mw := newManifestWriter()
+	both := io.MultiWriter(file, mw)
+	if this.MetaMgr.IsPrivate(topic) {
+		err = this.copyEncrypted(topic, writer, both, stream)
+	} else {
+		_, err = io.Copy(both, stream)
+	}
+	file.Close()
 	if err != nil {
 		_ = os.Remove(tmppath) // Ignore errors
 		return err
 	}
-	digest := hasher.Finalize()
+	manifest := mw.Finalize()
+	digest := crypto.HashOf(manifest)
 	okey := digest.String()
 
 	// Add info to DB
 	this.lock.Lock()
+	this.putManifest(okey, manifest)
 	obj := this.getObj(okey)
 	obj.newFile(tmppath)
+	obj.authored = true
 	obj.Holds++
 	this.writeObj(obj)
+	this.enforceQuota()
 	this.lock.Unlock()
 
 	// Put to meta-data layer
-	data, _ := transfer.EncodeBytes(digest)
-	err = this.MetaMgr.Put(topic, writer, key, data)
+	rec.Version = DataRecordVersion
+	rec.Digest = digest
+	rec.Size = int64(size)
+	if rec.ModTime == 0 {
+		rec.ModTime = time.Now().Unix()
+	}
+	if rec.Attrs == nil {
+		rec.Attrs = map[string]string{}
+	}
+	err = this.MetaMgr.Put(topic, writer, key, transfer.AsBytes(rec))
 
 	// Remove hold
 	this.lock.Lock()
@@ -404,33 +796,151 @@ func (this *DataMgr) PutData(topic string, key string, writer *crypto.SecretIden
 	return err
 }
 
-// Reads from io.Reader and generates a new object, put it to the meta-data layer
+// Gets the digest of the blob stored under a key, which is also its key in storage
+func (this *DataMgr) GetDigest(topic string, key string) (string, error) {
+	rec, err := this.GetRecord(topic, key)
+	if err != nil {
+		return "", err
+	}
+	return rec.Digest.String(), nil
+}
+
+// Random access to a blob
+type ReadSeekCloser interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// A local blob, held until it's closed
+type heldFile struct {
+	*os.File
+	mgr *DataMgr
+	key string
+}
+
+func (this *heldFile) Close() error {
+	err := this.File.Close()
+	this.mgr.lock.Lock()
+	obj := this.mgr.getObj(this.key)
+	obj.Holds--
+	this.mgr.writeObj(obj)
+	this.mgr.lock.Unlock()
+	return err
+}
+
+// Opens the local blob stored under a key for random access, only works for public
+// collections, since the blobs of private ones are encrypted.  The caller must close it.
+func (this *DataMgr) OpenData(topic string, key string) (ReadSeekCloser, error) {
+	if this.MetaMgr.IsPrivate(topic) {
+		return nil, fmt.Errorf("Unable to open data of a private collection")
+	}
+	okey, err := this.GetDigest(topic, key)
+	if err != nil {
+		return nil, err
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	obj := this.maybeGetObj(okey)
+	if obj == nil || obj.State != DSLocal {
+		return nil, fmt.Errorf("File not local yet")
+	}
+	file, err := os.Open(path.Join(this.dir, okey))
+	if err != nil {
+		return nil, err
+	}
+	obj.Holds++
+	obj.used = time.Now().Unix()
+	this.writeObj(obj)
+	return &heldFile{File: file, mgr: this, key: okey}, nil
+}
+
+// Gets the data stored under a key, failing if it isn't local yet
 func (this *DataMgr) GetData(topic string, key string, stream io.Writer) error {
-	data := this.Get(topic, key)
-	if data == nil {
-		return fmt.Errorf("Unknown key")
+	return this.GetDataWait(topic, key, stream, 0)
+}
+
+// Gets the data stored under a key.  If it isn't local, and wait is set, it's moved to the
+// front of the download queue, and streamed as it arrives, failing if the download stalls
+// for longer than wait.  On demand and evicted data is always waited for.
+func (this *DataMgr) GetDataWait(topic string, key string, stream io.Writer, wait time.Duration) error {
+	okey, err := this.GetDigest(topic, key)
+	if err != nil {
+		return err
 	}
-	var objHash *crypto.Digest
-	err := transfer.DecodeBytes(data, &objHash)
+	return this.getBlob(topic, key, okey, stream, wait)
+}
+
+// Gets the record of a previous version of a key
+func (this *DataMgr) GetVersionRecord(topic string, key string, version int) (*DataRecord, error) {
+	old := this.GetVersion(topic, key, version)
+	if old == nil || old.Value == nil {
+		return nil, fmt.Errorf("Unknown version")
+	}
+	return decodeRecord(old.Value)
+}
+
+// Gets the data of a previous version of a key, as GetDataWait does for the current one
+func (this *DataMgr) GetVersionData(topic string, key string, version int, stream io.Writer, wait time.Duration) error {
+	rec, err := this.GetVersionRecord(topic, key, version)
 	if err != nil {
 		return err
 	}
-	okey := objHash.String()
+	return this.getBlob(topic, key, rec.Digest.String(), stream, wait)
+}
 
+// Gets the record of one writer's value of a conflicting key
+func (this *DataMgr) GetSiblingRecord(topic string, key string, author string) (*DataRecord, error) {
+	value := this.GetSibling(topic, key, author)
+	if value == nil {
+		return nil, fmt.Errorf("Unknown sibling")
+	}
+	return decodeRecord(value)
+}
+
+// Gets the data of one writer's value of a conflicting key, as GetDataWait does
+func (this *DataMgr) GetSiblingData(topic string, key string, author string, stream io.Writer, wait time.Duration) error {
+	rec, err := this.GetSiblingRecord(topic, key, author)
+	if err != nil {
+		return err
+	}
+	return this.getBlob(topic, key, rec.Digest.String(), stream, wait)
+}
+
+// Gets the blob okey, which a value of key refers to
+func (this *DataMgr) getBlob(topic string, key string, okey string, stream io.Writer, wait time.Duration) error {
 	this.lock.Lock()
 	obj := this.maybeGetObj(okey)
-	if obj == nil || obj.State != DSLocal {
+	if obj == nil {
 		this.lock.Unlock()
 		return fmt.Errorf("File not local yet")
 	}
+	policy := this.GetPolicy(topic, key)
+	if obj.State != DSLocal && policy != PolicyNever {
+		if wait <= 0 && (obj.evicted || policy == PolicyOnDemand) {
+			wait = OnDemandTimeout
+		}
+		if wait > 0 {
+			// Asking for it is what brings it in
+			obj.wanted = true
+			this.download.Broadcast()
+		}
+	}
 	obj.Holds++
+	obj.used = time.Now().Unix()
 	this.writeObj(obj)
+	if policy == PolicyNever {
+		wait = 0
+	}
+	file, err := this.openBlob(okey, wait)
 	this.lock.Unlock()
 
-	name := path.Join(this.dir, okey)
-	file, err := os.Open(name)
 	if err == nil {
-		_, err = io.Copy(stream, file)
+		if this.MetaMgr.IsPrivate(topic) {
+			err = this.copyDecrypted(topic, stream, file)
+		} else {
+			_, err = io.Copy(stream, file)
+		}
+		file.Close()
 	}
 
 	this.lock.Lock()
@@ -441,3 +951,62 @@ func (this *DataMgr) GetData(topic string, key string, stream io.Writer) error {
 
 	return err
 }
+
+// Encrypts a blob of a private collection, prefixed by the generation of the key used
+func (this *DataMgr) copyEncrypted(topic string, writer *crypto.SecretIdentity, out io.Writer, in io.Reader) error {
+	keys := this.MetaMgr.GetKeys(topic, writer)
+	if keys == nil {
+		return fmt.Errorf("Unable to write to private collection, not a reader")
+	}
+	gen := len(keys) - 1
+	err := transfer.Encode(out, gen)
+	if err != nil {
+		return err
+	}
+	cw := crypto.NewCryptWriter(out, keys[gen].Encrypt())
+	_, err = io.Copy(cw, in)
+	if err != nil {
+		return err
+	}
+	return cw.Close()
+}
+
+// Decrypts a blob of a private collection, fails if the blob isn't authentic.  It's decrypted
+// to a temporary file, and only passed on once it's known to be authentic, so nothing is
+// written to out if it isn't.
+func (this *DataMgr) copyDecrypted(topic string, out io.Writer, in io.Reader) error {
+	keys := this.MetaMgr.GetKeys(topic, this.Ident)
+	if keys == nil {
+		return fmt.Errorf("Unable to read private collection, not a reader")
+	}
+	var gen int
+	err := transfer.Decode(in, &gen)
+	if err != nil {
+		return err
+	}
+	if gen < 0 || gen >= len(keys) {
+		return fmt.Errorf("Unknown key generation %d", gen)
+	}
+	tmppath := path.Join(this.incoming, crypto.RandomString())
+	file, err := os.OpenFile(tmppath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmppath)
+	defer file.Close()
+	cw := crypto.NewCryptWriter(file, keys[gen].Decrypt())
+	_, err = io.Copy(cw, in)
+	if err != nil {
+		return err
+	}
+	err = cw.Close()
+	if err != nil {
+		return err
+	}
+	_, err = file.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, file)
+	return err
+}
@@ -2,12 +2,16 @@ package data
 
 import (
 	"bytes"
+	"fmt"
 	"h0tb0x/link"
 	"h0tb0x/meta"
 	"h0tb0x/rendezvous"
 	"h0tb0x/sync"
 	"h0tb0x/test"
+	"h0tb0x/transfer"
+	"io/ioutil"
 	. "launchpad.net/gocheck"
+	"path"
 	"testing"
 	"time"
 )
@@ -77,6 +81,398 @@ func (this *TestDataSuite) TestData(c *C) {
 	err = bob.GetData(cid, "Kitten", &outbuf)
 	c.Assert(err, IsNil)
 	c.Assert(outbuf.Bytes(), DeepEquals, []byte("A GIF of a cute kitten"))
+	blob, err := bob.OpenData(cid, "Kitten")
+	c.Assert(err, IsNil)
+	_, err = blob.Seek(11, 0)
+	c.Assert(err, IsNil)
+	rest, err := ioutil.ReadAll(blob)
+	c.Assert(err, IsNil)
+	c.Assert(string(rest), Equals, "cute kitten")
+	c.Assert(blob.Close(), IsNil)
+
+	// Deleting the key drops the blob everywhere
+	key, err := alice.GetDigest(cid, "Kitten")
+	c.Assert(err, IsNil)
+	c.Assert(bob.maybeGetObj(key), NotNil)
+	c.Assert(alice.Delete(cid, alice.Ident, "Kitten"), IsNil)
+	time.Sleep(1 * time.Second)
+	c.Assert(alice.maybeGetObj(key), IsNil)
+	c.Assert(bob.maybeGetObj(key), IsNil)
+	outbuf.Reset()
+	c.Assert(bob.GetData(cid, "Kitten", &outbuf), NotNil)
+
+	alice.Stop()
+	bob.Stop()
+}
+
+func (this *TestDataSuite) TestPrivateData(c *C) {
+	this.C = c
+
+	alice := this.NewTestNode("A", 10001)
+	bob := this.NewTestNode("B", 10002)
+	carol := this.NewTestNode("C", 10003)
+
+	CreateLink(alice, bob)
+	CreateLink(alice, carol)
+	time.Sleep(1 * time.Second)
+
+	cid := alice.CreatePrivateCollection(alice.Ident)
+	c.Assert(alice.AddReader(cid, alice.Ident, bob.Ident.Public()), IsNil)
+	alice.Subscribe(bob.Ident.Fingerprint(), cid, true)
+	bob.Subscribe(alice.Ident.Fingerprint(), cid, true)
+	alice.Subscribe(carol.Ident.Fingerprint(), cid, true)
+	carol.Subscribe(alice.Ident.Fingerprint(), cid, true)
+	time.Sleep(1 * time.Second)
+
+	file := bytes.NewBuffer([]byte("A GIF of a secret kitten"))
+	err := alice.PutData(cid, "Kitten", alice.Ident, file)
+	c.Assert(err, IsNil)
+	time.Sleep(1 * time.Second)
+
+	var outbuf bytes.Buffer
+	err = bob.GetData(cid, "Kitten", &outbuf)
+	c.Assert(err, IsNil)
+	c.Assert(outbuf.Bytes(), DeepEquals, []byte("A GIF of a secret kitten"))
+
+	// If bob's copy is tampered with, none of it is passed on
+	objKey, err := bob.GetDigest(cid, "Kitten")
+	c.Assert(err, IsNil)
+	blob, err := ioutil.ReadFile(path.Join(bob.dir, objKey))
+	c.Assert(err, IsNil)
+	blob[len(blob)/2] ^= 1
+	c.Assert(ioutil.WriteFile(path.Join(bob.dir, objKey), blob, 0600), IsNil)
+	outbuf.Reset()
+	c.Assert(bob.GetData(cid, "Kitten", &outbuf), NotNil)
+	c.Assert(outbuf.Len(), Equals, 0)
+
+	// Carol isn't a reader
+	outbuf.Reset()
+	err = carol.GetData(cid, "Kitten", &outbuf)
+	c.Assert(err, NotNil)
+
+	alice.Stop()
+	bob.Stop()
+	carol.Stop()
+}
+
+func (this *TestDataSuite) TestChunks(c *C) {
+	this.C = c
+
+	alice := this.NewTestNode("A", 10001)
+	bob := this.NewTestNode("B", 10002)
+
+	CreateLink(alice, bob)
+	time.Sleep(1 * time.Second)
+
+	cid := alice.CreateNewCollection(alice.Ident)
+	alice.Subscribe(bob.Ident.Fingerprint(), cid, true)
+	bob.Subscribe(alice.Ident.Fingerprint(), cid, true)
+	time.Sleep(1 * time.Second)
+
+	// Something a few chunks long
+	blob := make([]byte, 2*ChunkSize+ChunkSize/2)
+	for i := range blob {
+		blob[i] = byte(i * 7)
+	}
+	err := alice.PutData(cid, "Video", alice.Ident, bytes.NewBuffer(blob))
+	c.Assert(err, IsNil)
+
+	objKey, err := alice.GetDigest(cid, "Video")
+	c.Assert(err, IsNil)
+	manifest := alice.getManifest(objKey)
+	c.Assert(manifest, NotNil)
+	c.Assert(manifest.valid(), Equals, true)
+	c.Assert(manifest.Chunks, HasLen, 3)
+	time.Sleep(2 * time.Second)
+
+	var outbuf bytes.Buffer
+	err = bob.GetData(cid, "Video", &outbuf)
+	c.Assert(err, IsNil)
+	c.Assert(outbuf.Bytes(), DeepEquals, blob)
+	c.Assert(bob.haveChunks(objKey), HasLen, 0)
+
+	alice.Stop()
+	bob.Stop()
+}
+
+func (this *TestDataSuite) TestSwarm(c *C) {
+	this.C = c
+
+	alice := this.NewTestNode("A", 10001)
+	bob := this.NewTestNode("B", 10002)
+	carol := this.NewTestNode("C", 10003)
+
+	CreateLink(alice, bob)
+	CreateLink(alice, carol)
+	CreateLink(bob, carol)
+	time.Sleep(1 * time.Second)
+
+	cid := alice.CreateNewCollection(alice.Ident)
+	alice.Subscribe(carol.Ident.Fingerprint(), cid, true)
+	carol.Subscribe(alice.Ident.Fingerprint(), cid, true)
+	time.Sleep(1 * time.Second)
+
+	// Alice puts a big blob and a few small ones, carol gets them all
+	blob := make([]byte, 3*ChunkSize+5)
+	for i := range blob {
+		blob[i] = byte(i * 13)
+	}
+	c.Assert(alice.PutData(cid, "Big", alice.Ident, bytes.NewBuffer(blob)), IsNil)
+	for i := 0; i < 6; i++ {
+		small := bytes.NewBuffer([]byte{byte(i)})
+		c.Assert(alice.PutData(cid, fmt.Sprintf("small%d", i), alice.Ident, small), IsNil)
+	}
+	time.Sleep(2 * time.Second)
+
+	// Now bob joins, and gets it from both of them
+	for _, other := range []*DataMgr{alice, carol} {
+		other.Subscribe(bob.Ident.Fingerprint(), cid, true)
+		bob.Subscribe(other.Ident.Fingerprint(), cid, true)
+	}
+	time.Sleep(3 * time.Second)
+
+	var outbuf bytes.Buffer
+	c.Assert(bob.GetData(cid, "Big", &outbuf), IsNil)
+	c.Assert(outbuf.Bytes(), DeepEquals, blob)
+	for i := 0; i < 6; i++ {
+		outbuf.Reset()
+		c.Assert(bob.GetData(cid, fmt.Sprintf("small%d", i), &outbuf), IsNil)
+		c.Assert(outbuf.Bytes(), DeepEquals, []byte{byte(i)})
+	}
+
+	alice.Stop()
+	bob.Stop()
+	carol.Stop()
+}
+
+func (this *TestDataSuite) TestBadData(c *C) {
+	this.C = c
+
+	alice := this.NewTestNode("A", 10001)
+	bob := this.NewTestNode("B", 10002)
+
+	CreateLink(alice, bob)
+	time.Sleep(1 * time.Second)
+
+	cid := alice.CreateNewCollection(alice.Ident)
+	alice.Subscribe(bob.Ident.Fingerprint(), cid, true)
+	bob.Subscribe(alice.Ident.Fingerprint(), cid, true)
+	time.Sleep(1 * time.Second)
+
+	// Alice's copy gets corrupted before bob fetches it
+	bob.lock.Lock()
+	c.Assert(alice.PutData(cid, "Kitten", alice.Ident, bytes.NewBuffer([]byte("A kitten"))), IsNil)
+	objKey, err := alice.GetDigest(cid, "Kitten")
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile(path.Join(alice.dir, objKey), []byte("A puppy!"), 0600)
+	c.Assert(err, IsNil)
+	bob.lock.Unlock()
+	time.Sleep(1 * time.Second)
+
+	// Bob rejects it, and holds it against alice
+	var outbuf bytes.Buffer
+	c.Assert(bob.GetData(cid, "Kitten", &outbuf), NotNil)
+	row := bob.Db.SingleQuery("SELECT id FROM Friend")
+	var aliceId int
+	bob.Db.Scan(row, &aliceId)
+	c.Assert(bob.badDataScore(aliceId) > 0, Equals, true)
+
+	// Friends over the limit go last, unless there is no one else
+	bob.checkBadData(aliceId, &badDataError{"x"})
+	bob.checkBadData(aliceId, &badDataError{"x"})
+	bob.checkBadData(aliceId+1, fmt.Errorf("Network trouble"))
+	c.Assert(bob.rankFriends([]int{aliceId, aliceId + 1}), DeepEquals, []int{aliceId + 1})
+	c.Assert(bob.rankFriends([]int{aliceId}), DeepEquals, []int{aliceId})
+
+	// Once forgiven, bad data counts from one again
+	bob.Db.Exec("UPDATE FriendScore SET last_bad = ? WHERE friend_id = ?",
+		time.Now().Add(-2*BadDataForget).Unix(), aliceId)
+	c.Assert(bob.badDataScore(aliceId), Equals, 0)
+	bob.checkBadData(aliceId, &badDataError{"x"})
+	c.Assert(bob.badDataScore(aliceId), Equals, 1)
+
+	alice.Stop()
+	bob.Stop()
+}
+
+func (this *TestDataSuite) TestQuota(c *C) {
+	this.C = c
+
+	alice := this.NewTestNode("A", 10001)
+	bob := this.NewTestNode("B", 10002)
+	bob.Quota = 250
+
+	CreateLink(alice, bob)
+	time.Sleep(1 * time.Second)
+
+	cid := alice.CreateNewCollection(alice.Ident)
+	alice.Subscribe(bob.Ident.Fingerprint(), cid, true)
+	bob.Subscribe(alice.Ident.Fingerprint(), cid, true)
+	time.Sleep(1 * time.Second)
+
+	// Bob only has room for two of alice's blobs, the oldest goes
+	for _, name := range []string{"A", "B", "C"} {
+		blob := bytes.Repeat([]byte(name), 100)
+		c.Assert(alice.PutData(cid, name, alice.Ident, bytes.NewBuffer(blob)), IsNil)
+		time.Sleep(1100 * time.Millisecond)
+	}
+	stats := bob.Storage()
+	c.Assert(stats.Used, Equals, int64(200))
+	c.Assert(stats.Blobs, Equals, 2)
+	c.Assert(stats.Evictions, Equals, 1)
+	c.Assert(stats.EvictedBytes, Equals, int64(100))
+	c.Assert(alice.Storage().Kept, Equals, int64(300))
+
+	// Asking for an evicted blob brings it back, pushing out the next oldest
+	var outbuf bytes.Buffer
+	c.Assert(bob.GetData(cid, "A", &outbuf), IsNil)
+	c.Assert(outbuf.Bytes(), DeepEquals, bytes.Repeat([]byte("A"), 100))
+	objKey, err := bob.GetDigest(cid, "B")
+	c.Assert(err, IsNil)
+	c.Assert(bob.maybeGetObj(objKey).evicted, Equals, true)
+	c.Assert(bob.Storage().Evictions, Equals, 2)
+
+	// Bob's own blobs and pinned ones stay, even over quota
+	c.Assert(bob.SetPolicy(cid, "C", PolicyEager), IsNil)
+	mine := bob.CreateNewCollection(bob.Ident)
+	blob := bytes.Repeat([]byte("M"), 200)
+	c.Assert(bob.PutData(mine, "Mine", bob.Ident, bytes.NewBuffer(blob)), IsNil)
+	stats = bob.Storage()
+	c.Assert(stats.Used, Equals, int64(300))
+	c.Assert(stats.Kept, Equals, int64(300))
+	c.Assert(stats.Blobs, Equals, 2)
+
+	alice.Stop()
+	bob.Stop()
+}
+
+func (this *TestDataSuite) TestPins(c *C) {
+	this.C = c
+
+	alice := this.NewTestNode("A", 10001)
+	bob := this.NewTestNode("B", 10002)
+
+	CreateLink(alice, bob)
+	time.Sleep(1 * time.Second)
+
+	// Bob only wants alice's blobs on demand, except for one key, and never another
+	cid := alice.CreateNewCollection(alice.Ident)
+	c.Assert(bob.SetPolicy(cid, "", PolicyOnDemand), IsNil)
+	c.Assert(bob.SetPolicy(cid, "Eager", PolicyEager), IsNil)
+	c.Assert(bob.SetPolicy(cid, "Never", PolicyNever), IsNil)
+	c.Assert(bob.SetPolicy(cid, "Bad", 7), NotNil)
+	c.Assert(bob.GetPins(cid), DeepEquals, []Pin{
+		{"", PolicyOnDemand}, {"Eager", PolicyEager}, {"Never", PolicyNever}})
+	alice.Subscribe(bob.Ident.Fingerprint(), cid, true)
+	bob.Subscribe(alice.Ident.Fingerprint(), cid, true)
+	time.Sleep(1 * time.Second)
+
+	for _, name := range []string{"Lazy", "Eager", "Never"} {
+		c.Assert(alice.PutData(cid, name, alice.Ident, bytes.NewBuffer([]byte(name))), IsNil)
+	}
+	time.Sleep(1 * time.Second)
+	stats := bob.Storage()
+	c.Assert(stats.Blobs, Equals, 1)
+	c.Assert(stats.Kept, Equals, int64(len("Eager")))
+
+	// Getting an on demand key waits for it
+	var outbuf bytes.Buffer
+	c.Assert(bob.GetData(cid, "Lazy", &outbuf), IsNil)
+	c.Assert(outbuf.String(), Equals, "Lazy")
+	c.Assert(bob.GetData(cid, "Never", &outbuf), NotNil)
+
+	// Dropping the collection policy makes everything else eager
+	bob.ClearPolicy(cid, "")
+	c.Assert(bob.GetPolicy(cid, "Lazy"), Equals, PolicyEager)
+	c.Assert(bob.GetPolicy(cid, "Never"), Equals, PolicyNever)
+	bob.ClearPolicy(cid, "Never")
+	time.Sleep(1 * time.Second)
+	c.Assert(bob.Storage().Blobs, Equals, 3)
+
+	alice.Stop()
+	bob.Stop()
+}
+
+func (this *TestDataSuite) TestWait(c *C) {
+	this.C = c
+
+	alice := this.NewTestNode("A", 10001)
+	bob := this.NewTestNode("B", 10002)
+	bob.lock.Lock()
+	bob.MaxDownloads = 0
+	bob.lock.Unlock()
+
+	CreateLink(alice, bob)
+	time.Sleep(1 * time.Second)
+
+	cid := alice.CreateNewCollection(alice.Ident)
+	alice.Subscribe(bob.Ident.Fingerprint(), cid, true)
+	bob.Subscribe(alice.Ident.Fingerprint(), cid, true)
+	time.Sleep(1 * time.Second)
+
+	blob := make([]byte, 2*ChunkSize+100)
+	for i := range blob {
+		blob[i] = byte(i * 11)
+	}
+	c.Assert(alice.PutData(cid, "Video", alice.Ident, bytes.NewBuffer(blob)), IsNil)
+	time.Sleep(1 * time.Second)
+
+	// Bob isn't downloading anything, so waiting gives up
+	var outbuf bytes.Buffer
+	c.Assert(bob.GetData(cid, "Video", &outbuf), NotNil)
+	c.Assert(bob.GetDataWait(cid, "Video", &outbuf, 500*time.Millisecond), NotNil)
+
+	// Once he is, it's streamed to him as it arrives
+	bob.lock.Lock()
+	bob.MaxDownloads = 1
+	bob.download.Broadcast()
+	bob.lock.Unlock()
+	outbuf.Reset()
+	c.Assert(bob.GetDataWait(cid, "Video", &outbuf, 10*time.Second), IsNil)
+	c.Assert(outbuf.Bytes(), DeepEquals, blob)
+
+	alice.Stop()
+	bob.Stop()
+}
+
+func (this *TestDataSuite) TestRecords(c *C) {
+	this.C = c
+
+	alice := this.NewTestNode("A", 10001)
+	bob := this.NewTestNode("B", 10002)
+
+	CreateLink(alice, bob)
+	time.Sleep(1 * time.Second)
+
+	cid := alice.CreateNewCollection(alice.Ident)
+	alice.Subscribe(bob.Ident.Fingerprint(), cid, true)
+	bob.Subscribe(alice.Ident.Fingerprint(), cid, true)
+	time.Sleep(1 * time.Second)
+
+	before := time.Now().Unix()
+	err := alice.PutDataRecord(cid, "Kitten", alice.Ident, bytes.NewBuffer([]byte("A kitten")),
+		&DataRecord{ContentType: "image/gif", Attrs: map[string]string{"name": "Fluffy"}})
+	c.Assert(err, IsNil)
+	time.Sleep(1 * time.Second)
+
+	rec, err := bob.GetRecord(cid, "Kitten")
+	c.Assert(err, IsNil)
+	c.Assert(rec.Version, Equals, DataRecordVersion)
+	c.Assert(rec.Size, Equals, int64(len("A kitten")))
+	c.Assert(rec.ContentType, Equals, "image/gif")
+	c.Assert(rec.ModTime >= before, Equals, true)
+	c.Assert(rec.Attrs, DeepEquals, map[string]string{"name": "Fluffy"})
+
+	// Values from before records are just the digest
+	c.Assert(alice.Put(cid, alice.Ident, "Old", transfer.AsBytes(rec.Digest)), IsNil)
+	time.Sleep(1 * time.Second)
+	old, err := bob.GetRecord(cid, "Old")
+	c.Assert(err, IsNil)
+	c.Assert(old.Version, Equals, 0)
+	c.Assert(old.Digest.Equal(rec.Digest), Equals, true)
+	var outbuf bytes.Buffer
+	c.Assert(bob.GetData(cid, "Old", &outbuf), IsNil)
+	c.Assert(outbuf.String(), Equals, "A kitten")
 
 	alice.Stop()
 	bob.Stop()
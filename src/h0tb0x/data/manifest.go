@@ -0,0 +1,132 @@
+package data
+
+import (
+	"h0tb0x/crypto"
+	"h0tb0x/transfer"
+)
+
+// Blobs are split into chunks of this size, only the last chunk may be smaller
+const ChunkSize = 1 << 20
+
+// Special chunk numbers in data requests
+const (
+	chunkManifest = -1 // Request the manifest
+	chunkAll      = -2 // Request the whole blob, used for legacy blobs
+)
+
+// Describes how a blob is split into chunks, the key of a chunked blob is the hash of its manifest
+type Manifest struct {
+	Size      int64            // The total size of the blob
+	ChunkSize int              // The size of every chunk but the last
+	Chunks    []*crypto.Digest // The hash of each chunk
+}
+
+// The offset and length of a chunk
+func (this *Manifest) chunkRange(idx int) (offset int64, size int64) {
+	offset = int64(idx) * int64(this.ChunkSize)
+	size = this.Size - offset
+	if size > int64(this.ChunkSize) {
+		size = int64(this.ChunkSize)
+	}
+	return
+}
+
+// Checks the manifest is self consistent, since it comes from remote writers
+func (this *Manifest) valid() bool {
+	if this.ChunkSize <= 0 || this.Size < 0 {
+		return false
+	}
+	count := (this.Size + int64(this.ChunkSize) - 1) / int64(this.ChunkSize)
+	return count == int64(len(this.Chunks))
+}
+
+// The key of the blob described by the manifest
+func (this *Manifest) key() string {
+	return crypto.HashOf(this).String()
+}
+
+// Splits everything written to it into chunks, building a manifest
+type manifestWriter struct {
+	manifest Manifest
+	hasher   crypto.Hasher
+	fill     int
+}
+
+func newManifestWriter() *manifestWriter {
+	return &manifestWriter{manifest: Manifest{ChunkSize: ChunkSize, Chunks: []*crypto.Digest{}}}
+}
+
+func (this *manifestWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if this.hasher == nil {
+			this.hasher = crypto.NewHasher()
+		}
+		todo := this.manifest.ChunkSize - this.fill
+		if todo > len(p) {
+			todo = len(p)
+		}
+		this.hasher.Write(p[:todo])
+		this.fill += todo
+		this.manifest.Size += int64(todo)
+		p = p[todo:]
+		if this.fill == this.manifest.ChunkSize {
+			this.endChunk()
+		}
+	}
+	return n, nil
+}
+
+func (this *manifestWriter) endChunk() {
+	this.manifest.Chunks = append(this.manifest.Chunks, this.hasher.Finalize())
+	this.hasher = nil
+	this.fill = 0
+}
+
+// Returns the manifest of everything written
+func (this *manifestWriter) Finalize() *Manifest {
+	if this.fill > 0 {
+		this.endChunk()
+	}
+	return &this.manifest
+}
+
+// Gets the manifest of a blob, nil for legacy blobs or if I don't know it yet
+func (this *DataMgr) getManifest(key string) *Manifest {
+	row := this.Db.SingleQuery("SELECT data FROM Manifest WHERE key = ?", key)
+	var data []byte
+	if !this.Db.MaybeScan(row, &data) {
+		return nil
+	}
+	var manifest *Manifest
+	err := transfer.DecodeBytes(data, &manifest)
+	if err != nil {
+		panic(err)
+	}
+	return manifest
+}
+
+func (this *DataMgr) putManifest(key string, manifest *Manifest) {
+	this.Db.Exec("INSERT OR REPLACE INTO Manifest (key, data) VALUES (?, ?)",
+		key, transfer.AsBytes(manifest))
+}
+
+// Gets which chunks of a partial download I already have
+func (this *DataMgr) haveChunks(key string) map[int]bool {
+	rows := this.Db.MultiQuery("SELECT idx FROM Chunk WHERE key = ?", key)
+	out := make(map[int]bool)
+	for rows.Next() {
+		var idx int
+		this.Db.Scan(rows, &idx)
+		out[idx] = true
+	}
+	return out
+}
+
+// Checks if I have a chunk of a partial download
+func (this *DataMgr) haveChunk(key string, idx int) bool {
+	row := this.Db.SingleQuery("SELECT COUNT(*) FROM Chunk WHERE key = ? AND idx = ?", key, idx)
+	var count int
+	this.Db.Scan(row, &count)
+	return count > 0
+}
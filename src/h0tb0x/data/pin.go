@@ -0,0 +1,146 @@
+package data
+
+import (
+	"fmt"
+	"h0tb0x/sync"
+)
+
+// Download policies, for a whole collection or a single key
+const (
+	PolicyEager    = 0 // Download as soon as a friend has it, the default
+	PolicyOnDemand = 1 // Download when someone asks for it
+	PolicyNever    = 2 // Never download
+)
+
+// A download policy set by the user, Key is empty for the whole collection
+type Pin struct {
+	Key    string
+	Policy int
+}
+
+// Records which blob a key refers to
+func (this *DataMgr) addRef(topic string, key string, blob string) {
+	this.Db.Exec("INSERT OR REPLACE INTO Ref (topic, key, blob) VALUES (?, ?, ?)",
+		topic, key, blob)
+}
+
+func (this *DataMgr) delRef(topic string, key string, blob string) {
+	this.Db.Exec("DELETE FROM Ref WHERE topic = ? AND key = ? AND blob = ?",
+		topic, key, blob)
+}
+
+// Fills in the refs of data from before they were tracked.  Blobs of data I'm the current
+// writer of are marked authored, since they were from before that was tracked too, and they
+// may be the only copy.
+func (this *DataMgr) fillRefs() {
+	row := this.Db.SingleQuery("SELECT COUNT(*) FROM Ref")
+	var count int
+	this.Db.Scan(row, &count)
+	if count > 0 {
+		return
+	}
+	rows := this.Db.MultiQuery("SELECT DISTINCT topic, key FROM Object WHERE type = ?",
+		sync.RTData)
+	type topicKey struct{ topic, key string }
+	all := []topicKey{}
+	for rows.Next() {
+		var tk topicKey
+		this.Db.Scan(rows, &tk.topic, &tk.key)
+		all = append(all, tk)
+	}
+	me := this.Ident.Fingerprint().String()
+	for _, tk := range all {
+		rec, err := this.GetRecord(tk.topic, tk.key)
+		if err != nil {
+			continue
+		}
+		this.addRef(tk.topic, tk.key, rec.Digest.String())
+		if this.MetaMgr.GetDataAuthor(tk.topic, tk.key) != me {
+			continue
+		}
+		if obj := this.maybeGetObj(rec.Digest.String()); obj != nil && !obj.authored {
+			obj.authored = true
+			this.writeObj(obj)
+		}
+	}
+}
+
+// Works out what the keys referring to a blob want, should it be downloaded, and
+// is it pinned so it's never evicted
+func (this *DataMgr) refPolicy(blob string) (eager bool, pinned bool) {
+	row := this.Db.SingleQuery(`
+		SELECT IFNULL(MAX(p IS NULL OR p = ?), 0), IFNULL(MAX(p = ?), 0) FROM (
+			SELECT COALESCE(k.policy, c.policy) AS p FROM Ref r
+			LEFT JOIN Pin k ON k.topic = r.topic AND k.key = r.key
+			LEFT JOIN Pin c ON c.topic = r.topic AND c.key = ''
+			WHERE r.blob = ?)`,
+		PolicyEager, PolicyEager, blob)
+	this.Db.Scan(row, &eager, &pinned)
+	return
+}
+
+// Gets the policy in effect for a key
+func (this *DataMgr) GetPolicy(topic string, key string) int {
+	row := this.Db.SingleQuery(`
+		SELECT policy FROM Pin WHERE topic = ? AND key IN (?, '')
+		ORDER BY key DESC LIMIT 1`,
+		topic, key)
+	policy := PolicyEager
+	this.Db.MaybeScan(row, &policy)
+	return policy
+}
+
+// Gets the policies set for a collection
+func (this *DataMgr) GetPins(topic string) []Pin {
+	rows := this.Db.MultiQuery("SELECT key, policy FROM Pin WHERE topic = ? ORDER BY key", topic)
+	out := []Pin{}
+	for rows.Next() {
+		var pin Pin
+		this.Db.Scan(rows, &pin.Key, &pin.Policy)
+		out = append(out, pin)
+	}
+	return out
+}
+
+// Sets the policy of a key, or the whole collection if key is empty
+func (this *DataMgr) SetPolicy(topic string, key string, policy int) error {
+	if policy < PolicyEager || policy > PolicyNever {
+		return fmt.Errorf("Invalid policy: %d", policy)
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.Db.Exec("INSERT OR REPLACE INTO Pin (topic, key, policy) VALUES (?, ?, ?)",
+		topic, key, policy)
+	this.repin(topic, key)
+	return nil
+}
+
+// Removes the policy of a key, or the whole collection if key is empty
+func (this *DataMgr) ClearPolicy(topic string, key string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.Db.Exec("DELETE FROM Pin WHERE topic = ? AND key = ?", topic, key)
+	this.repin(topic, key)
+}
+
+// Updates the blobs affected by a policy change
+func (this *DataMgr) repin(topic string, key string) {
+	// A collection wide pin affects every key
+	rows := this.Db.MultiQuery(`
+		SELECT DISTINCT blob FROM Ref WHERE topic = ? AND (key = ? OR ? = '')`,
+		topic, key, key)
+	blobs := []string{}
+	for rows.Next() {
+		var blob string
+		this.Db.Scan(rows, &blob)
+		blobs = append(blobs, blob)
+	}
+	for _, blob := range blobs {
+		obj := this.maybeGetObj(blob)
+		if obj != nil {
+			this.writeObj(obj)
+		}
+	}
+	this.download.Broadcast()
+	this.enforceQuota()
+}
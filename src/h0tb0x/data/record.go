@@ -0,0 +1,57 @@
+package data
+
+import (
+	"fmt"
+	"h0tb0x/crypto"
+	"h0tb0x/transfer"
+)
+
+// The current version of data records, later versions may only add fields at the end
+const DataRecordVersion = 1
+
+// Legacy data records are just the digest of the blob
+const legacyRecordSize = 28
+
+// The meta-data value stored for each key of a collection
+type DataRecord struct {
+	Version     int               // DataRecordVersion, or 0 for legacy records
+	Digest      *crypto.Digest    // The key of the blob
+	Size        int64             // The size of the data, 0 for legacy records
+	ContentType string            // The MIME type, if known
+	ModTime     int64             // Unix time the data was put, 0 for legacy records
+	Attrs       map[string]string // Anything else the writer wants to say about it
+}
+
+func decodeRecord(data []byte) (*DataRecord, error) {
+	if len(data) == legacyRecordSize {
+		var digest *crypto.Digest
+		err := transfer.DecodeBytes(data, &digest)
+		if err != nil {
+			return nil, err
+		}
+		return &DataRecord{Digest: digest, Attrs: map[string]string{}}, nil
+	}
+	var rec *DataRecord
+	err := transfer.DecodeBytes(data, &rec)
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// Gets the data record stored under a key
+func (this *DataMgr) GetRecord(topic string, key string) (*DataRecord, error) {
+	data := this.Get(topic, key)
+	if data == nil {
+		return nil, fmt.Errorf("Unknown key")
+	}
+	return decodeRecord(data)
+}
+
+// Counts what's written to it
+type byteCounter int64
+
+func (this *byteCounter) Write(p []byte) (int, error) {
+	*this += byteCounter(len(p))
+	return len(p), nil
+}
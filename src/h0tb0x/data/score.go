@@ -0,0 +1,89 @@
+package data
+
+import (
+	"fmt"
+	"h0tb0x/crypto"
+	"h0tb0x/link"
+	"sort"
+	"time"
+)
+
+const (
+	BadDataLimit  = 3              // Friends with this many bad downloads are only used as a last resort
+	BadDataForget = 24 * time.Hour // Bad downloads older than this are forgiven
+)
+
+// Returned when a friend sends data which fails verification
+type badDataError struct {
+	key string
+}
+
+func (this *badDataError) Error() string {
+	return fmt.Sprintf("Data for blob %s failed to verify", this.key)
+}
+
+// Records the friend as having sent bad data, if that's what err is.  If the last bad data
+// was forgiven, the count starts over.
+func (this *DataMgr) checkBadData(friend int, err error) {
+	if _, ok := err.(*badDataError); !ok {
+		return
+	}
+	this.Log.Printf("Friend %d sent bad data: %s", friend, err)
+	now := time.Now()
+	this.Db.Exec("INSERT OR IGNORE INTO FriendScore (friend_id) VALUES (?)", friend)
+	this.Db.Exec(`
+		UPDATE FriendScore SET
+			bad_data = CASE WHEN last_bad > ? THEN bad_data + 1 ELSE 1 END,
+			last_bad = ?
+		WHERE friend_id = ?`,
+		now.Add(-BadDataForget).Unix(), now.Unix(), friend)
+}
+
+// Gets how many recent bad downloads a friend is responsible for
+func (this *DataMgr) badDataScore(friend int) int {
+	row := this.Db.SingleQuery("SELECT bad_data FROM FriendScore WHERE friend_id = ? AND last_bad > ?",
+		friend, time.Now().Add(-BadDataForget).Unix())
+	var score int
+	if !this.Db.MaybeScan(row, &score) {
+		return 0
+	}
+	return score
+}
+
+// Sorts friends by their score, lowest first
+type byScore struct {
+	friends []int
+	scores  map[int]int
+}
+
+func (this *byScore) Len() int { return len(this.friends) }
+func (this *byScore) Less(i, j int) bool {
+	return this.scores[this.friends[i]] < this.scores[this.friends[j]]
+}
+func (this *byScore) Swap(i, j int) {
+	this.friends[i], this.friends[j] = this.friends[j], this.friends[i]
+}
+
+// Orders friends best first, friends over the limit are dropped unless they are all that's left
+func (this *DataMgr) rankFriends(friends []int) []int {
+	scores := make(map[int]int)
+	for _, friend := range friends {
+		scores[friend] = this.badDataScore(friend)
+	}
+	sort.Stable(&byScore{friends, scores})
+	good := 0
+	for good < len(friends) && scores[friends[good]] < BadDataLimit {
+		good++
+	}
+	if good == 0 {
+		return friends
+	}
+	return friends[:good]
+}
+
+// Forgets the score of friends who are removed
+func (this *DataMgr) onFriendChange(id int, fp *crypto.Digest, what link.FriendStatus) {
+	if what == link.FriendRemoved {
+		this.Db.Exec("DELETE FROM FriendScore WHERE friend_id = ?", id)
+	}
+}
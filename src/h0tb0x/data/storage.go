@@ -0,0 +1,88 @@
+package data
+
+import (
+	"os"
+	"path"
+)
+
+// Storage usage and eviction statistics
+type StorageStats struct {
+	Quota        int64 // Bytes of storage allowed, 0 if unlimited
+	Used         int64 // Bytes of blobs stored locally
+	Kept         int64 // Bytes of local blobs which are never evicted, since they are authored or pinned
+	Blobs        int   // Number of blobs stored locally
+	Evictions    int   // Number of blobs evicted since startup
+	EvictedBytes int64 // Bytes evicted since startup
+}
+
+// Removes the local copy of a blob, it can be downloaded again on demand
+func (this *DataObj) evict() {
+	this.mgr.Log.Printf("Evicting %s", this.Key)
+	os.Remove(path.Join(this.mgr.dir, this.Key))
+	for topic, _ := range this.Tracking {
+		this.mgr.advertize(topic, this.Key, false)
+	}
+	this.State = DSNotReady
+	if this.mgr.anyAdverts(this.Key) {
+		this.State = DSReady
+	}
+	this.evicted = true
+	this.size = 0
+}
+
+// Evicts least recently used blobs until local storage is under the quota
+func (this *DataMgr) enforceQuota() {
+	if this.Quota <= 0 {
+		return
+	}
+	var used int64
+	row := this.Db.SingleQuery("SELECT IFNULL(SUM(size), 0) FROM Blob")
+	this.Db.Scan(row, &used)
+	if used <= this.Quota {
+		return
+	}
+	rows := this.Db.MultiQuery(`
+		SELECT key FROM Blob
+		WHERE size > 0 AND authored = 0 AND pinned = 0
+		ORDER BY used`)
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		this.Db.Scan(rows, &key)
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		if used <= this.Quota {
+			break
+		}
+		obj := this.getObj(key)
+		if obj.State != DSLocal || obj.Holds > 0 {
+			continue
+		}
+		used -= obj.size
+		this.evictions++
+		this.evictedBytes += obj.size
+		obj.evict()
+		this.writeObj(obj)
+	}
+	if used > this.Quota {
+		this.Log.Printf("Unable to get under quota, %d bytes used", used)
+	}
+}
+
+// Gets the current storage usage and eviction statistics
+func (this *DataMgr) Storage() *StorageStats {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	stats := &StorageStats{
+		Quota:        this.Quota,
+		Evictions:    this.evictions,
+		EvictedBytes: this.evictedBytes,
+	}
+	row := this.Db.SingleQuery(`
+		SELECT IFNULL(SUM(size), 0), COUNT(*),
+			IFNULL(SUM(CASE WHEN authored = 1 OR pinned = 1 THEN size ELSE 0 END), 0)
+		FROM Blob WHERE size > 0`)
+	this.Db.Scan(row, &stats.Used, &stats.Blobs, &stats.Kept)
+	return stats
+}
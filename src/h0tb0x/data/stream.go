@@ -0,0 +1,111 @@
+package data
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+// Waits until a download makes progress or the deadline passes, returns false if
+// the deadline passed.  Call with the lock held.
+func (this *DataMgr) waitFetched(deadline time.Time) bool {
+	left := deadline.Sub(time.Now())
+	if left <= 0 {
+		return false
+	}
+	timer := time.AfterFunc(left, func() {
+		this.lock.Lock()
+		this.fetched.Broadcast()
+		this.lock.Unlock()
+	})
+	this.fetched.Wait()
+	timer.Stop()
+	return time.Now().Before(deadline)
+}
+
+// Reads a blob while it's downloaded, each read waits for the chunk it needs
+type partialReader struct {
+	mgr      *DataMgr
+	key      string
+	manifest *Manifest
+	timeout  time.Duration // How long to wait for a chunk
+	file     *os.File      // Opened once the first chunk arrives
+	offset   int64
+}
+
+func (this *partialReader) Read(p []byte) (int, error) {
+	if this.offset >= this.manifest.Size {
+		return 0, io.EOF
+	}
+	idx := int(this.offset / int64(this.manifest.ChunkSize))
+	mgr := this.mgr
+	deadline := time.Now().Add(this.timeout)
+	mgr.lock.Lock()
+	for {
+		obj := mgr.maybeGetObj(this.key)
+		local := obj != nil && obj.State == DSLocal
+		if local || mgr.haveChunk(this.key, idx) {
+			if this.file == nil {
+				// Once done, the partial file is renamed, so an open one stays good
+				name := path.Join(mgr.incoming, this.key)
+				if local {
+					name = path.Join(mgr.dir, this.key)
+				}
+				file, err := os.Open(name)
+				if err != nil {
+					mgr.lock.Unlock()
+					return 0, err
+				}
+				this.file = file
+			}
+			break
+		}
+		if obj == nil || (obj.State == DSNotReady && !obj.Downloading) || mgr.isClosing ||
+			!mgr.waitFetched(deadline) {
+			mgr.lock.Unlock()
+			return 0, fmt.Errorf("Download of %s stalled", this.key)
+		}
+	}
+	mgr.lock.Unlock()
+	offset, size := this.manifest.chunkRange(idx)
+	if left := offset + size - this.offset; int64(len(p)) > left {
+		p = p[:left]
+	}
+	n, err := this.file.ReadAt(p, this.offset)
+	this.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (this *partialReader) Close() error {
+	if this.file == nil {
+		return nil
+	}
+	return this.file.Close()
+}
+
+// Opens a blob for reading, if it's still downloading, waits for it to be local, or
+// if it's chunked, for it to start arriving.  Call with the lock held.
+func (this *DataMgr) openBlob(key string, timeout time.Duration) (io.ReadCloser, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		obj := this.maybeGetObj(key)
+		if obj == nil {
+			return nil, fmt.Errorf("File not local yet")
+		}
+		if obj.State == DSLocal {
+			return os.Open(path.Join(this.dir, key))
+		}
+		if manifest := this.getManifest(key); manifest != nil && timeout > 0 {
+			return &partialReader{mgr: this, key: key, manifest: manifest, timeout: timeout}, nil
+		}
+		if (obj.State == DSNotReady && !obj.Downloading) || this.isClosing ||
+			!this.waitFetched(deadline) {
+			return nil, fmt.Errorf("File not local yet")
+		}
+	}
+}
@@ -0,0 +1,12 @@
+-- The manifests of chunked blobs, legacy blobs have none
+CREATE TABLE IF NOT EXISTS Manifest(
+	key TEXT NOT NULL PRIMARY KEY,
+	data BLOB NOT NULL
+);
+
+-- The chunks of partially downloaded blobs I already have
+CREATE TABLE IF NOT EXISTS Chunk(
+	key TEXT NOT NULL,
+	idx INTEGER NOT NULL,
+	PRIMARY KEY(key, idx)
+);
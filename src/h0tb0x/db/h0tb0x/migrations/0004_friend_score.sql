@@ -0,0 +1,6 @@
+-- Tracks friends which sent data that failed to verify
+CREATE TABLE IF NOT EXISTS FriendScore(
+	friend_id INTEGER NOT NULL PRIMARY KEY,
+	bad_data INTEGER NOT NULL DEFAULT(0),  -- How many times they sent bad data
+	last_bad INTEGER NOT NULL DEFAULT(0)  -- Unix time of the last time
+);
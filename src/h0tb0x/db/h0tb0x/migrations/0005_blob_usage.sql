@@ -0,0 +1,9 @@
+-- Bytes on disk, 0 if not local
+ALTER TABLE Blob ADD COLUMN size INTEGER NOT NULL DEFAULT(0);
+-- Unix time of last use
+ALTER TABLE Blob ADD COLUMN used INTEGER NOT NULL DEFAULT(0);
+ALTER TABLE Blob ADD COLUMN authored BOOL NOT NULL DEFAULT(0);
+ALTER TABLE Blob ADD COLUMN pinned BOOL NOT NULL DEFAULT(0);
+ALTER TABLE Blob ADD COLUMN evicted BOOL NOT NULL DEFAULT(0);
+-- Blobs I wrote are marked authored on startup, from the data records, when refs are filled in
+CREATE INDEX IF NOT EXISTS IDX_Blob_used ON Blob (used);
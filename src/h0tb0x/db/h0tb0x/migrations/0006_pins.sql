@@ -0,0 +1,17 @@
+-- Has someone asked for the blob, if so it's downloaded whatever the policy
+ALTER TABLE Blob ADD COLUMN wanted BOOL NOT NULL DEFAULT(0);
+-- Download policies for collections (with an empty key) and keys
+CREATE TABLE IF NOT EXISTS Pin(
+	topic TEXT NOT NULL,
+	key TEXT NOT NULL,
+	policy INTEGER NOT NULL,
+	PRIMARY KEY(topic, key)
+);
+-- Which blob each key refers to, filled in on startup for existing data
+CREATE TABLE IF NOT EXISTS Ref(
+	topic TEXT NOT NULL,
+	key TEXT NOT NULL,
+	blob TEXT NOT NULL,
+	PRIMARY KEY(topic, key)
+);
+CREATE INDEX IF NOT EXISTS IDX_Ref_blob ON Ref (blob);
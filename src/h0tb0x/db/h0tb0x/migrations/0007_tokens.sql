@@ -0,0 +1,8 @@
+-- Bearer tokens for the local API, only a hash of each is kept
+CREATE TABLE IF NOT EXISTS Token(
+	name TEXT NOT NULL PRIMARY KEY,
+	hash TEXT NOT NULL UNIQUE,
+	scope INTEGER NOT NULL,
+	topic TEXT NOT NULL,
+	created INTEGER NOT NULL
+);
@@ -0,0 +1,10 @@
+-- Collections offered to friends, and by them
+CREATE TABLE IF NOT EXISTS Invite(
+	friend_id INTEGER NOT NULL,
+	topic TEXT NOT NULL,
+	outgoing BOOL NOT NULL,
+	role INTEGER NOT NULL,
+	state INTEGER NOT NULL,
+	created INTEGER NOT NULL,
+	PRIMARY KEY(friend_id, topic, outgoing)
+);
@@ -0,0 +1,15 @@
+-- How many previous versions of each key to keep, by collection
+CREATE TABLE IF NOT EXISTS Retention(
+	topic TEXT NOT NULL PRIMARY KEY,
+	versions INTEGER NOT NULL
+);
+-- Previous values of data keys, kept when they're overwritten or deleted
+CREATE TABLE IF NOT EXISTS History(
+	topic TEXT NOT NULL,
+	key TEXT NOT NULL,
+	version INTEGER NOT NULL,
+	value BLOB NOT NULL,
+	author TEXT NOT NULL,
+	created INTEGER NOT NULL,
+	PRIMARY KEY(topic, key, version)
+);
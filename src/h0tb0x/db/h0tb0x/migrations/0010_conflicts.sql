@@ -0,0 +1,10 @@
+-- The values of keys written by more than one writer at the same priority
+CREATE TABLE IF NOT EXISTS Conflict(
+	topic TEXT NOT NULL,
+	key TEXT NOT NULL,
+	author TEXT NOT NULL,
+	priority INTEGER NOT NULL,
+	value BLOB NOT NULL,
+	detected INTEGER NOT NULL,
+	PRIMARY KEY(topic, key, author)
+);
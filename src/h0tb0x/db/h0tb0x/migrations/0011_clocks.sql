@@ -0,0 +1,4 @@
+-- Hybrid logical clock of the record, existing records have none and go by priority
+ALTER TABLE Object ADD COLUMN clock INTEGER NOT NULL DEFAULT(0);
+DROP INDEX IF EXISTS IDX_Object_topic;
+CREATE INDEX IF NOT EXISTS IDX_Object_topic ON Object (topic, type, key, clock, priority);
@@ -7,6 +7,7 @@ CREATE TABLE Object(
 	priority INT NOT NULL DEFAULT(0),
 	author TEXT NOT NULL,
 	signature BLOB NULL,
+	clock INTEGER NOT NULL DEFAULT(0),
 	PRIMARY KEY(topic, type, author, key)
 );
 
@@ -32,9 +33,100 @@ CREATE TABLE TopicFriend(
 CREATE TABLE Blob(
 	key TEXT NOT NULL PRIMARY KEY,
 	needs_download BOOL NOT NULL,
+	data BLOB NOT NULL,
+	size INTEGER NOT NULL DEFAULT(0), -- Bytes on disk, 0 if not local
+	used INTEGER NOT NULL DEFAULT(0), -- Unix time of last use
+	authored BOOL NOT NULL DEFAULT(0),
+	pinned BOOL NOT NULL DEFAULT(0),
+	evicted BOOL NOT NULL DEFAULT(0),
+	wanted BOOL NOT NULL DEFAULT(0) -- Has someone asked for it, if so it's downloaded whatever the policy
+);
+
+-- Download policies for collections (with an empty key) and keys
+CREATE TABLE Pin(
+	topic TEXT NOT NULL,
+	key TEXT NOT NULL,
+	policy INTEGER NOT NULL,
+	PRIMARY KEY(topic, key)
+);
+
+-- Which blob each key refers to
+CREATE TABLE Ref(
+	topic TEXT NOT NULL,
+	key TEXT NOT NULL,
+	blob TEXT NOT NULL,
+	PRIMARY KEY(topic, key)
+);
+
+-- Bearer tokens for the local API, only a hash of each is kept
+CREATE TABLE Token(
+	name TEXT NOT NULL PRIMARY KEY,
+	hash TEXT NOT NULL UNIQUE,
+	scope INTEGER NOT NULL, -- 0 = read-only, 1 = one collection, 2 = admin
+	topic TEXT NOT NULL, -- The collection of a collection token, empty otherwise
+	created INTEGER NOT NULL
+);
+
+-- Collections offered to friends, and by them
+CREATE TABLE Invite(
+	friend_id INTEGER NOT NULL,
+	topic TEXT NOT NULL,
+	outgoing BOOL NOT NULL, -- Did I send it, or receive it
+	role INTEGER NOT NULL, -- 0 = reader, 1 = writer
+	state INTEGER NOT NULL, -- 0 = pending, 1 = accepted, 2 = rejected
+	created INTEGER NOT NULL,
+	PRIMARY KEY(friend_id, topic, outgoing)
+);
+
+-- How many previous versions of each key to keep, by collection, none if it isn't set
+CREATE TABLE Retention(
+	topic TEXT NOT NULL PRIMARY KEY,
+	versions INTEGER NOT NULL
+);
+
+-- Previous values of data keys, kept when they're overwritten or deleted
+CREATE TABLE History(
+	topic TEXT NOT NULL,
+	key TEXT NOT NULL,
+	version INTEGER NOT NULL, -- Counts up from 1 for each key
+	value BLOB NOT NULL, -- As it was stored, so sealed in private collections
+	author TEXT NOT NULL,
+	created INTEGER NOT NULL, -- Unix time it was replaced
+	PRIMARY KEY(topic, key, version)
+);
+
+-- The values of keys written by more than one writer at the same priority, each writer
+-- working from the same earlier value, one row for each of them
+CREATE TABLE Conflict(
+	topic TEXT NOT NULL,
+	key TEXT NOT NULL,
+	author TEXT NOT NULL,
+	priority INTEGER NOT NULL,
+	value BLOB NOT NULL, -- As it was stored, empty for a delete
+	detected INTEGER NOT NULL, -- Unix time the conflict was first seen
+	PRIMARY KEY(topic, key, author)
+);
+
+-- The manifests of chunked blobs, legacy blobs have none
+CREATE TABLE Manifest(
+	key TEXT NOT NULL PRIMARY KEY,
 	data BLOB NOT NULL
 );
 
+-- The chunks of partially downloaded blobs I already have
+CREATE TABLE Chunk(
+	key TEXT NOT NULL,
+	idx INTEGER NOT NULL,
+	PRIMARY KEY(key, idx)
+);
+
+-- Tracks friends which sent data that failed to verify
+CREATE TABLE FriendScore(
+	friend_id INTEGER NOT NULL PRIMARY KEY,
+	bad_data INTEGER NOT NULL DEFAULT(0),  -- How many times they sent bad data
+	last_bad INTEGER NOT NULL DEFAULT(0)  -- Unix time of the last time
+);
+
 -- Represents incoming adverts
 CREATE TABLE Advert(
 	key TEXT NOT NULL,
@@ -62,4 +154,6 @@ CREATE UNIQUE INDEX IDX_Object_seqno ON Object (seqno);
 CREATE UNIQUE INDEX IDX_Blob ON Blob (key);
 CREATE INDEX IDX_TopicFriend_check ON TopicFriend (friend_id, desired, requested);
 CREATE INDEX IDX_Blob_needs_download ON Blob (needs_download);
-CREATE INDEX IDX_Object_topic ON Object (topic, type, key, priority);
+CREATE INDEX IDX_Blob_used ON Blob (used);
+CREATE INDEX IDX_Ref_blob ON Ref (blob);
+CREATE INDEX IDX_Object_topic ON Object (topic, type, key, clock, priority);
@@ -10,8 +10,10 @@ import (
 	"h0tb0x/rendezvous"
 	"h0tb0x/transfer"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 )
@@ -25,8 +27,9 @@ const (
 )
 
 const (
-	ServiceNotify = 1
-	ServiceData   = 2
+	ServiceNotify    = 3 // Was 1 before records had signed clocks, which older peers can't verify
+	ServiceData      = 2
+	ServiceOldNotify = 1 // Only answered to tell older peers why they aren't synced
 )
 
 const (
@@ -138,6 +141,9 @@ func (this *LinkMgr) ServeHTTP(response http.ResponseWriter, request *http.Reque
 		return
 	}
 
+	// Learn the key of friends from the handshake, it's ignored for strangers
+	this.AddPublicKey(ident.Fingerprint(), ident)
+
 	if request.Header.Get("Content-Type") != "application/binary" {
 		this.respondError(response, http.StatusBadRequest, "Invalid content type")
 		return
@@ -268,6 +274,7 @@ func (this *LinkMgr) dial(proto, host string) (net.Conn, error) {
 		fi.failed = true
 		return nil, err
 	}
+	this.AddPublicKey(fi.fingerprint, ident)
 	return conn, nil
 }
 
@@ -408,6 +415,39 @@ func (this *LinkMgr) UpdateHostData(fp *crypto.Digest, host string, port uint16)
 	return fi
 }
 
+// Records the public key of a friend, which must match its fingerprint.  Since the
+// fingerprint is a hash of the key, a friend only ever has one.
+func (this *LinkMgr) AddPublicKey(fp *crypto.Digest, key *crypto.PublicIdentity) error {
+	if key.Fingerprint().String() != fp.String() {
+		return fmt.Errorf("Public key doesn't match fingerprint: %s", fp)
+	}
+	if this.GetPublicKey(fp) != nil {
+		return nil
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	fi, ok := this.friendsByFp[fp.String()]
+	if !ok {
+		return fmt.Errorf("Unknown friend: %s", fp)
+	}
+	if fi.publicKey == nil {
+		this.Db.Exec("UPDATE Friend SET public_key = ? WHERE id = ?", transfer.AsBytes(key), fi.id)
+		fi.publicKey = key
+	}
+	return nil
+}
+
+// Gets the public key of a friend, nil if it isn't known yet
+func (this *LinkMgr) GetPublicKey(fp *crypto.Digest) *crypto.PublicIdentity {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	fi, ok := this.friendsByFp[fp.String()]
+	if !ok {
+		return nil
+	}
+	return fi.publicKey
+}
+
 // Add a new friend, or if the friend exists, update the host and port data.
 func (this *LinkMgr) RemoveFriend(fp *crypto.Digest) {
 	this.mutex.Lock()
@@ -434,6 +474,10 @@ func (this *LinkMgr) Send(service int, id int, req io.Reader, wr io.Writer) erro
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		if resp.StatusCode == http.StatusForbidden && strings.HasPrefix(string(msg), "Unknown service") {
+			return fmt.Errorf("Friend %s is too old for service %d, it needs upgrading", fi.fingerprint, service)
+		}
 		return fmt.Errorf("RPC had non 200 http return code: %d", resp.StatusCode)
 	}
 	if resp.Header.Get("Content-Type") != "application/binary" {
@@ -100,8 +100,23 @@ func (this *TestLinkSuite) TestLink(c *C) {
 	c.Assert(buf.String(), Equals, "123")
 
 	buf = new(bytes.Buffer)
+	// A service the friend doesn't have means it's older than us
 	err = alice.Link.Send(3, 1, bytes.NewBuffer([]byte{5, 4, 3}), buf)
-	c.Assert(err, ErrorMatches, "*403$")
+	c.Assert(err, ErrorMatches, "Friend .* is too old for service 3, it needs upgrading")
+
+	// Both sides learned the other's key from the handshake
+	aliceFp := alice.Ident.Fingerprint()
+	bobFp := bob.Ident.Fingerprint()
+	c.Assert(alice.Link.GetPublicKey(bobFp), NotNil)
+	c.Assert(alice.Link.GetPublicKey(bobFp).Fingerprint().Equal(bobFp), Equals, true)
+	c.Assert(bob.Link.GetPublicKey(aliceFp), NotNil)
+	var keyBin []byte
+	row := alice.Db.SingleQuery("SELECT public_key FROM Friend WHERE fingerprint = ?", bobFp.Bytes())
+	c.Assert(alice.Db.MaybeScan(row, &keyBin), Equals, true)
+	c.Assert(keyBin, NotNil)
+
+	// Keys which don't match the fingerprint are refused
+	c.Assert(alice.Link.AddPublicKey(bobFp, alice.Ident.Public()), NotNil)
 
 	alice.Stop()
 	bob.Stop()
@@ -2,6 +2,7 @@ package main
 
 import (
 	"code.google.com/p/gopass"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -28,6 +29,7 @@ import (
 )
 
 const (
+	DefaultApiHost    = "127.0.0.1" // Only local programs may use the API
 	DefaultApiPort    = 8000
 	DefaultLinkPort   = 31337 // Should allow 0 to be automatic
 	DefaultExtHost    = ""    // Automatic
@@ -41,11 +43,17 @@ const (
 )
 
 type Config struct {
-	ApiPort    uint16 // Port for user API calls, must be set
-	LinkPort   uint16 // Port of other h0tb0x's to talk to, 0 *should* means pick randomly, doesn't work yet
-	ExtHost    string // External host (for hand forwarding), Empty means use nat-pmp
-	ExtPort    uint16 // External port (for hand forwarding), 0 means use nat-pmp
-	Rendezvous string // Rendezvous server to use
+	ApiHost      string // Address to listen for user API calls on, empty means DefaultApiHost
+	ApiPort      uint16 // Port for user API calls, must be set
+	ApiTls       bool   // Serve the API over https, with the node identity unless ApiCert is set
+	ApiCert      string // PEM certificate file for the API, relative to the h0tb0x directory
+	ApiKey       string // PEM key file for ApiCert
+	LinkPort     uint16 // Port of other h0tb0x's to talk to, 0 *should* means pick randomly, doesn't work yet
+	ExtHost      string // External host (for hand forwarding), Empty means use nat-pmp
+	ExtPort      uint16 // External port (for hand forwarding), 0 means use nat-pmp
+	Rendezvous   string // Rendezvous server to use
+	MaxDownloads int    // How many blobs to download at once, 0 means use the default
+	Quota        int64  // Bytes of blobs to keep locally, 0 means no limit
 }
 
 func fatal(msg string, err error) {
@@ -88,11 +96,13 @@ func newH0tb0x(dir string) {
 	fmt.Printf("Generating default config, you may want to check %s to make sure values are correct\n", cfgFilename)
 
 	config := &Config{
-		ApiPort:    DefaultApiPort,
-		LinkPort:   DefaultLinkPort,
-		ExtHost:    DefaultExtHost,
-		ExtPort:    DefaultExtPort,
-		Rendezvous: DefaultRendezvous,
+		ApiHost:      DefaultApiHost,
+		ApiPort:      DefaultApiPort,
+		LinkPort:     DefaultLinkPort,
+		ExtHost:      DefaultExtHost,
+		ExtPort:      DefaultExtPort,
+		Rendezvous:   DefaultRendezvous,
+		MaxDownloads: data.DefaultMaxDownloads,
 	}
 	configFile, err := os.Create(cfgFilename)
 	if err != nil {
@@ -122,6 +132,68 @@ func newH0tb0x(dir string) {
 	identFile.Close()
 }
 
+// Loads the API certificate from the config, or makes one from the node identity
+func apiCertificate(dir string, config *Config, ident *crypto.SecretIdentity) *tls.Certificate {
+	if config.ApiCert == "" {
+		return ident.TlsCertificate()
+	}
+	certFile := config.ApiCert
+	keyFile := config.ApiKey
+	if !path.IsAbs(certFile) {
+		certFile = path.Join(dir, certFile)
+	}
+	if !path.IsAbs(keyFile) {
+		keyFile = path.Join(dir, keyFile)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		fatal("Unable to load API certificate", err)
+	}
+	return &cert
+}
+
+const tokenUsage = `usage: h0tb0x token create <name> read|admin
+       h0tb0x token create <name> collection <cid>
+       h0tb0x token list
+       h0tb0x token revoke <name>`
+
+// Manages the tokens which allow using the API
+func tokenCommand(dbFilename string, args []string) {
+	if len(args) == 0 {
+		fatal(tokenUsage, nil)
+	}
+	thedb := db.NewDatabase(dbFilename, "h0tb0x")
+	defer thedb.Close()
+	switch {
+	case args[0] == "create" && (len(args) == 3 || len(args) == 4):
+		scope := -1
+		for s, name := range api.ScopeNames {
+			if name == args[2] {
+				scope = s
+			}
+		}
+		cid := ""
+		if len(args) == 4 {
+			cid = args[3]
+		}
+		token, err := api.CreateToken(thedb, args[1], scope, cid)
+		if err != nil {
+			fatal("", err)
+		}
+		fmt.Println(token)
+	case args[0] == "list" && len(args) == 1:
+		for _, token := range api.ListTokens(thedb) {
+			fmt.Printf("%s\t%s\t%s\t%s\n", token.Name, token.Scope, token.Created, token.Cid)
+		}
+	case args[0] == "revoke" && len(args) == 2:
+		if !api.RevokeToken(thedb, args[1]) {
+			fatal(fmt.Sprintf("No such token: %s", args[1]), nil)
+		}
+	default:
+		fatal(tokenUsage, nil)
+	}
+}
+
 func main() {
 	connMgr := conn.NewNetConnMgr()
 	user, err := user.Current()
@@ -150,6 +222,14 @@ func main() {
 	idFilename := path.Join(*dir, IdFilename)
 	dataDir := path.Join(*dir, "data")
 
+	if flag.Arg(0) == "token" {
+		if fi, err := os.Stat(*dir); err != nil || !fi.IsDir() {
+			fatal(fmt.Sprintf("h0tb0x directory %s doesn't exist", *dir), nil)
+		}
+		tokenCommand(dbFilename, flag.Args()[1:])
+		return
+	}
+
 	var config *Config
 	var thedb *db.Database
 	var ident *crypto.SecretIdentity
@@ -182,6 +262,9 @@ func main() {
 			fatal("", err)
 		}
 		thedb = db.NewDatabase(dbFilename, "h0tb0x")
+		if config.ApiHost == "" {
+			config.ApiHost = DefaultApiHost
+		}
 	} else {
 		fmt.Printf("h0tb0x directory %s doesn't exist\n", *dir)
 		newH0tb0x(*dir)
@@ -189,11 +272,17 @@ func main() {
 		os.Exit(1)
 	}
 	fmt.Printf("Running with config: \n")
+	fmt.Printf("  ApiHost: %s\n", config.ApiHost)
 	fmt.Printf("  ApiPort: %d\n", config.ApiPort)
+	fmt.Printf("  ApiTls: %v\n", config.ApiTls)
+	fmt.Printf("  ApiCert: %s\n", config.ApiCert)
+	fmt.Printf("  ApiKey: %s\n", config.ApiKey)
 	fmt.Printf("  LinkPort: %d\n", config.LinkPort)
 	fmt.Printf("  Rendezvous: %s\n", config.Rendezvous)
 	fmt.Printf("  ExtHost: %s\n", config.ExtHost)
 	fmt.Printf("  ExtPort: %d\n", config.ExtPort)
+	fmt.Printf("  MaxDownloads: %d\n", config.MaxDownloads)
+	fmt.Printf("  Quota: %d\n", config.Quota)
 
 	var extHost net.IP
 	var extPort uint16
@@ -225,8 +314,23 @@ func main() {
 	sync := sync.NewSyncMgr(link)
 	meta := meta.NewMetaMgr(sync)
 	data := data.NewDataMgr(dataDir, meta)
-	api := api.NewApiMgr(config.Rendezvous, config.ApiPort, data, connMgr)
+	if config.MaxDownloads > 0 {
+		data.MaxDownloads = config.MaxDownloads
+	}
+	data.Quota = config.Quota
+	var tlsCert *tls.Certificate
+	if config.ApiTls || config.ApiCert != "" {
+		tlsCert = apiCertificate(*dir, config, ident)
+		fingerprint, err := api.TlsFingerprint(tlsCert)
+		if err != nil {
+			fatal("Invalid API certificate", err)
+		}
+		// Clients pin the key, since the certificate can't be checked otherwise
+		fmt.Printf("API key fingerprint: %s\n", fingerprint)
+	}
+	api := api.NewApiMgr(config.Rendezvous, config.ApiHost, config.ApiPort, data, connMgr)
 	api.SetExt(extHost, extPort)
+	api.TlsCert = tlsCert
 
 	stopTime := make(chan bool)
 	var stopWait gosync.WaitGroup
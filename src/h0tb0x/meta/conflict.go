@@ -0,0 +1,203 @@
+package meta
+
+import (
+	"bytes"
+	"h0tb0x/sync"
+	"time"
+)
+
+// One writer's value of a conflicting key
+type Sibling struct {
+	Author  string // The fingerprint of the writer
+	Value   []byte // The plaintext, nil for a delete, or if I'm unable to read it
+	Deleted bool   // Was it a delete
+	Current bool   // Is it the value Get returns
+}
+
+// A key more than one writer changed from the same earlier value, none of them knowing
+// about the others.  It lasts until someone writes the key again.
+type Conflict struct {
+	Key      string
+	Priority int       // The priority of the current value
+	Detected time.Time // When it was first seen
+	Siblings []*Sibling
+}
+
+// Adds a callback told when a conflicting value is kept (up) or dropped (down), so the
+// data layer can hold on to the blobs they refer to
+func (this *MetaMgr) AddConflictCallback(callback MetaMgrCallback) {
+	this.conflictCallbacks = append(this.conflictCallbacks, callback)
+}
+
+func (this *MetaMgr) signalConflict(cid string, key string, value []byte, author string, isUp bool) {
+	data := this.openValue(cid, value)
+	if data == nil {
+		return
+	}
+	for _, cb := range this.conflictCallbacks {
+		cb(cid, key, data, author, isUp)
+	}
+}
+
+// Compares values by plaintext if possible, sealing the same value twice gives different bytes
+func (this *MetaMgr) sameValue(cid string, lhs []byte, rhs []byte) bool {
+	lhsData := this.openValue(cid, lhs)
+	rhsData := this.openValue(cid, rhs)
+	if lhsData != nil && rhsData != nil {
+		return bytes.Equal(lhsData, rhsData)
+	}
+	return bytes.Equal(lhs, rhs)
+}
+
+// Records the siblings of a key after a record of it is stored.  New siblings are kept and
+// signaled up at once, the dropped ones are returned, so they can go down once the new
+// current value is up.
+//
+// Siblings are the current value and those of writers it hadn't seen.  A write's priority
+// is above every one its writer had seen, and it would be current had it seen the current
+// value, so any value with a priority at least the current one's is a sibling.
+func (this *MetaMgr) updateConflict(cid string, key string) []*sync.Record {
+	cur := this.SyncMgr.Get(sync.RTData, cid, key)
+	rows := this.Db.MultiQuery(`
+		SELECT author, priority, value FROM Object
+		WHERE topic = ? AND type = ? AND key = ? AND priority >= ?
+		ORDER BY clock DESC, priority DESC, author DESC`,
+		cid, sync.RTData, key, cur.Priority)
+	siblings := []*sync.Record{}
+	for rows.Next() {
+		rec := &sync.Record{Topic: cid, Key: key}
+		this.Db.Scan(rows, &rec.Author, &rec.Priority, &rec.Value)
+		siblings = append(siblings, rec)
+	}
+	conflicting := false
+	for i := 1; i < len(siblings); i++ {
+		if !this.sameValue(cid, siblings[0].Value, siblings[i].Value) {
+			conflicting = true
+		}
+	}
+	if !conflicting {
+		siblings = nil
+	}
+
+	// What's kept now
+	rows = this.Db.MultiQuery("SELECT author, priority, value FROM Conflict WHERE topic = ? AND key = ?",
+		cid, key)
+	kept := make(map[string]*sync.Record)
+	for rows.Next() {
+		rec := &sync.Record{Topic: cid, Key: key}
+		this.Db.Scan(rows, &rec.Author, &rec.Priority, &rec.Value)
+		kept[rec.Author] = rec
+	}
+
+	now := time.Now().Unix()
+	for _, rec := range siblings {
+		old := kept[rec.Author]
+		if old != nil && old.Priority == rec.Priority && bytes.Equal(old.Value, rec.Value) {
+			delete(kept, rec.Author)
+			continue
+		}
+		this.Db.Exec(`
+			REPLACE INTO Conflict (topic, key, author, priority, value, detected)
+			VALUES (?, ?, ?, ?, ?, IFNULL((SELECT MIN(detected) FROM Conflict
+				WHERE topic = ? AND key = ?), ?))`,
+			cid, key, rec.Author, rec.Priority, rec.Value, cid, key, now)
+		this.signalConflict(cid, key, rec.Value, rec.Author, true)
+	}
+	dropped := []*sync.Record{}
+	for author, rec := range kept {
+		// An author still a sibling had its row replaced above, only the old value goes
+		if !this.isSibling(siblings, author) {
+			this.Db.Exec("DELETE FROM Conflict WHERE topic = ? AND key = ? AND author = ?",
+				cid, key, author)
+		}
+		dropped = append(dropped, rec)
+	}
+	return dropped
+}
+
+func (this *MetaMgr) isSibling(siblings []*sync.Record, author string) bool {
+	for _, rec := range siblings {
+		if rec.Author == author {
+			return true
+		}
+	}
+	return false
+}
+
+// Lets go of siblings which were dropped
+func (this *MetaMgr) dropSiblings(dropped []*sync.Record) {
+	for _, rec := range dropped {
+		this.signalConflict(rec.Topic, rec.Key, rec.Value, rec.Author, false)
+	}
+}
+
+// Drops every conflict in a collection
+func (this *MetaMgr) dropConflicts(cid string) {
+	rows := this.Db.MultiQuery("SELECT key, author, value FROM Conflict WHERE topic = ?", cid)
+	dropped := []*sync.Record{}
+	for rows.Next() {
+		rec := &sync.Record{Topic: cid}
+		this.Db.Scan(rows, &rec.Key, &rec.Author, &rec.Value)
+		dropped = append(dropped, rec)
+	}
+	this.Db.Exec("DELETE FROM Conflict WHERE topic = ?", cid)
+	this.dropSiblings(dropped)
+}
+
+// Gets the conflicts in a collection, in key order
+func (this *MetaMgr) GetConflicts(cid string) []*Conflict {
+	rows := this.Db.MultiQuery("SELECT DISTINCT key FROM Conflict WHERE topic = ? ORDER BY key", cid)
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		this.Db.Scan(rows, &key)
+		keys = append(keys, key)
+	}
+	out := []*Conflict{}
+	for _, key := range keys {
+		if conflict := this.GetConflict(cid, key); conflict != nil {
+			out = append(out, conflict)
+		}
+	}
+	return out
+}
+
+// Gets the conflict on a key, nil if there is none
+func (this *MetaMgr) GetConflict(cid string, key string) *Conflict {
+	rows := this.Db.MultiQuery(`
+		SELECT author, priority, value, detected FROM Conflict
+		WHERE topic = ? AND key = ? ORDER BY author`,
+		cid, key)
+	cur := this.SyncMgr.Get(sync.RTData, cid, key)
+	var out *Conflict
+	for rows.Next() {
+		var priority int
+		var value []byte
+		var detected int64
+		sibling := &Sibling{}
+		this.Db.Scan(rows, &sibling.Author, &priority, &value, &detected)
+		if out == nil {
+			out = &Conflict{Key: key, Priority: priority, Detected: time.Unix(detected, 0)}
+		}
+		sibling.Value = this.openValue(cid, value)
+		sibling.Deleted = len(value) == 0
+		sibling.Current = cur != nil && cur.Author == sibling.Author
+		if sibling.Current {
+			out.Priority = priority
+		}
+		out.Siblings = append(out.Siblings, sibling)
+	}
+	return out
+}
+
+// Gets one writer's value of a conflicting key, nil if it isn't a sibling, it was a delete,
+// or I'm unable to read it
+func (this *MetaMgr) GetSibling(cid string, key string, author string) []byte {
+	row := this.Db.SingleQuery("SELECT value FROM Conflict WHERE topic = ? AND key = ? AND author = ?",
+		cid, key, author)
+	var value []byte
+	if !this.Db.MaybeScan(row, &value) {
+		return nil
+	}
+	return this.openValue(cid, value)
+}
@@ -0,0 +1,172 @@
+package meta
+
+import (
+	"fmt"
+	"h0tb0x/crypto"
+	"h0tb0x/sync"
+	"time"
+)
+
+// A previous value of a key, kept when it was overwritten or deleted
+type Version struct {
+	Version int       // Counts up from 1 for each key, the latest is the highest
+	Value   []byte    // The plaintext, nil if I'm unable to read it
+	Author  string    // The fingerprint of the writer of the value
+	Created time.Time // When it was replaced
+}
+
+// Adds a callback told when a previous value is kept (up) or dropped (down), so the
+// data layer can hold on to the blobs they refer to
+func (this *MetaMgr) AddHistoryCallback(callback MetaMgrCallback) {
+	this.historyCallbacks = append(this.historyCallbacks, callback)
+}
+
+func (this *MetaMgr) signalHistory(cid string, key string, value []byte, author string, isUp bool) {
+	data := this.openValue(cid, value)
+	if data == nil {
+		return
+	}
+	for _, cb := range this.historyCallbacks {
+		cb(cid, key, data, author, isUp)
+	}
+}
+
+// Gets how many previous versions of each key of a collection are kept
+func (this *MetaMgr) GetRetention(cid string) int {
+	versions := 0
+	row := this.Db.SingleQuery("SELECT versions FROM Retention WHERE topic = ?", cid)
+	this.Db.MaybeScan(row, &versions)
+	return versions
+}
+
+// Sets how many previous versions of each key of a collection are kept, 0 keeps none.
+// This is local, and only keeps values replaced from now on.
+func (this *MetaMgr) SetRetention(cid string, versions int) error {
+	if versions < 0 {
+		return fmt.Errorf("Unable to set retention of cid '%s', invalid count", cid)
+	}
+	if this.GetOwner(cid) == nil || this.IsClosed(cid) {
+		return fmt.Errorf("Unable to set retention of cid '%s', no such collection", cid)
+	}
+	if versions == 0 {
+		this.Db.Exec("DELETE FROM Retention WHERE topic = ?", cid)
+	} else {
+		this.Db.Exec("REPLACE INTO Retention (topic, versions) VALUES (?, ?)", cid, versions)
+	}
+	rows := this.Db.MultiQuery("SELECT DISTINCT key FROM History WHERE topic = ?", cid)
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		this.Db.Scan(rows, &key)
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		this.pruneHistory(cid, key, versions)
+	}
+	return nil
+}
+
+// Keeps the value of a record which was replaced, if the collection keeps history
+func (this *MetaMgr) keepVersion(old *sync.Record) {
+	if len(old.Value) == 0 {
+		return
+	}
+	versions := this.GetRetention(old.Topic)
+	if versions == 0 {
+		return
+	}
+	this.Db.Exec(`
+		INSERT INTO History (topic, key, version, value, author, created)
+		VALUES (?, ?, IFNULL((SELECT MAX(version) FROM History WHERE topic = ? AND key = ?), 0)+1,
+			?, ?, ?)`,
+		old.Topic, old.Key, old.Topic, old.Key, old.Value, old.Author, time.Now().Unix())
+	this.signalHistory(old.Topic, old.Key, old.Value, old.Author, true)
+	this.pruneHistory(old.Topic, old.Key, versions)
+}
+
+// Drops all but the latest keep versions of a key
+func (this *MetaMgr) pruneHistory(cid string, key string, keep int) {
+	rows := this.Db.MultiQuery(`
+		SELECT version, value, author FROM History WHERE topic = ? AND key = ?
+		ORDER BY version DESC LIMIT -1 OFFSET ?`,
+		cid, key, keep)
+	type dropped struct {
+		version int
+		value   []byte
+		author  string
+	}
+	all := []dropped{}
+	for rows.Next() {
+		var d dropped
+		this.Db.Scan(rows, &d.version, &d.value, &d.author)
+		all = append(all, d)
+	}
+	for _, d := range all {
+		this.Db.Exec("DELETE FROM History WHERE topic = ? AND key = ? AND version = ?",
+			cid, key, d.version)
+		this.signalHistory(cid, key, d.value, d.author, false)
+	}
+}
+
+// Drops every previous version in a collection
+func (this *MetaMgr) dropHistory(cid string) {
+	rows := this.Db.MultiQuery("SELECT DISTINCT key FROM History WHERE topic = ?", cid)
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		this.Db.Scan(rows, &key)
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		this.pruneHistory(cid, key, 0)
+	}
+	this.Db.Exec("DELETE FROM Retention WHERE topic = ?", cid)
+}
+
+// Gets the previous versions of a key, latest first
+func (this *MetaMgr) GetHistory(cid string, key string) []*Version {
+	rows := this.Db.MultiQuery(`
+		SELECT version, value, author, created FROM History WHERE topic = ? AND key = ?
+		ORDER BY version DESC`,
+		cid, key)
+	out := []*Version{}
+	for rows.Next() {
+		var value []byte
+		var created int64
+		version := &Version{}
+		this.Db.Scan(rows, &version.Version, &value, &version.Author, &created)
+		version.Value = this.openValue(cid, value)
+		version.Created = time.Unix(created, 0)
+		out = append(out, version)
+	}
+	return out
+}
+
+// Gets a previous version of a key, nil if it isn't kept
+func (this *MetaMgr) GetVersion(cid string, key string, version int) *Version {
+	row := this.Db.SingleQuery(`
+		SELECT value, author, created FROM History WHERE topic = ? AND key = ? AND version = ?`,
+		cid, key, version)
+	var value []byte
+	var created int64
+	out := &Version{Version: version}
+	if !this.Db.MaybeScan(row, &value, &out.Author, &created) {
+		return nil
+	}
+	out.Value = this.openValue(cid, value)
+	out.Created = time.Unix(created, 0)
+	return out
+}
+
+// Makes a previous version of a key the current value again, the current value, if any,
+// becomes a previous version in turn
+func (this *MetaMgr) Restore(cid string, writer *crypto.SecretIdentity, key string, version int) error {
+	old := this.GetVersion(cid, key, version)
+	if old == nil {
+		return fmt.Errorf("Unable to restore '%s' in cid '%s', no version %d", key, cid, version)
+	}
+	if old.Value == nil {
+		return fmt.Errorf("Unable to restore '%s' in cid '%s', unable to read version %d", key, cid, version)
+	}
+	return this.Put(cid, writer, key, old.Value)
+}
@@ -0,0 +1,86 @@
+package meta
+
+import (
+	"fmt"
+	"h0tb0x/crypto"
+	"h0tb0x/sync"
+	"h0tb0x/transfer"
+	"time"
+)
+
+// Human-readable details of a collection, set by its owner.  The icon is data in the
+// collection, IconDigest is its digest when the icon was set, so clients can tell if it
+// was changed since.  In private collections, the info is sealed like data.
+type CollectionInfo struct {
+	Name        string
+	Description string
+	IconKey     string
+	IconDigest  string
+	Created     int64 // Unix time the info was first set
+}
+
+// Sets the info of a collection I own, keeping the time it was first set
+func (this *MetaMgr) SetInfo(cid string, owner *crypto.SecretIdentity, info *CollectionInfo) error {
+	curOwner := this.GetOwner(cid)
+	if curOwner == nil || curOwner.Fingerprint().String() != owner.Fingerprint().String() {
+		return fmt.Errorf("Unable to set info of cid '%s', not a collection I own", cid)
+	}
+	if this.IsClosed(cid) {
+		return fmt.Errorf("Unable to set info of cid '%s', it's closed", cid)
+	}
+	updated := *info
+	priority := 0
+	old := this.SyncMgr.Get(sync.RTBasis, cid, "info")
+	if old != nil {
+		priority = old.Priority + 1
+	}
+	if cur := this.GetInfo(cid); cur != nil && cur.Created != 0 {
+		updated.Created = cur.Created
+	} else {
+		updated.Created = time.Now().Unix()
+	}
+	value := transfer.AsBytes(&updated)
+	if keys := this.GetKeys(cid, owner); keys != nil {
+		value = seal(keys, value)
+	}
+	rec := &sync.Record{
+		RecordType: sync.RTBasis,
+		Topic:      cid,
+		Key:        "info",
+		Value:      value,
+		Priority:   priority,
+	}
+	this.signRecord(rec, owner)
+	this.SyncMgr.Put(rec)
+	return nil
+}
+
+// Gets the info of a collection, nil if it has none or I'm unable to read it
+func (this *MetaMgr) GetInfo(cid string) *CollectionInfo {
+	rec := this.SyncMgr.Get(sync.RTBasis, cid, "info")
+	if rec == nil {
+		return nil
+	}
+	value := this.openValue(cid, rec.Value)
+	if value == nil {
+		return nil
+	}
+	var info *CollectionInfo
+	if transfer.DecodeBytes(value, &info) != nil {
+		return nil
+	}
+	return info
+}
+
+func (this *MetaMgr) onInfo(rec *sync.Record) {
+	owner := this.GetOwner(rec.Topic)
+	if owner == nil {
+		this.Log.Printf("Getting info before basis, ignoring")
+		return
+	}
+	if rec.Author != owner.Fingerprint().String() {
+		this.Log.Printf("Info not from the owner, ignoring")
+		return
+	}
+	this.verifyUpdate(rec, owner)
+}
@@ -0,0 +1,191 @@
+package meta
+
+import (
+	"fmt"
+	"h0tb0x/crypto"
+	"h0tb0x/link"
+	"h0tb0x/sync"
+	"h0tb0x/transfer"
+	"time"
+)
+
+// What an invite offers
+const (
+	RoleReader = 0 // Subscribe, and read if the collection is private
+	RoleWriter = 1 // Also write
+)
+
+// Where an invite is at
+const (
+	InvitePending  = 0
+	InviteAccepted = 1
+	InviteRejected = 2
+)
+
+// An invite to a collection, sent to a friend or received from one
+type Invite struct {
+	Cid      string
+	Friend   *crypto.Digest
+	Role     int
+	State    int
+	Outgoing bool // Sent by me
+	Created  time.Time
+}
+
+// The value of an invite record, sent through my outbox to a friend.  Offers are pending,
+// answers are accepted or rejected.  Key is the sender's, so the inviter can add whoever
+// accepts as a writer or reader.
+type inviteMesg struct {
+	Role  int
+	State int
+	Key   *crypto.PublicIdentity
+}
+
+func (this *MetaMgr) friendId(fp *crypto.Digest) (int, bool) {
+	var id int
+	row := this.Db.SingleQuery("SELECT id FROM Friend WHERE fingerprint = ?", fp.Bytes())
+	return id, this.Db.MaybeScan(row, &id)
+}
+
+func (this *MetaMgr) putInvite(friend *crypto.Digest, cid string, role int, state int) {
+	mesg := &inviteMesg{Role: role, State: state, Key: this.Ident.Public()}
+	this.SyncMgr.Put(&sync.Record{
+		RecordType: sync.RTInvite,
+		Topic:      this.OutboxTopic(friend),
+		Key:        cid,
+		Value:      transfer.AsBytes(mesg),
+		Author:     "$",
+	})
+}
+
+// Offers a collection I own to a friend
+func (this *MetaMgr) SendInvite(friend *crypto.Digest, cid string, role int) error {
+	if role != RoleReader && role != RoleWriter {
+		return fmt.Errorf("Unable to invite to cid '%s', invalid role", cid)
+	}
+	owner := this.GetOwner(cid)
+	if owner == nil || !owner.Fingerprint().Equal(this.Ident.Fingerprint()) {
+		return fmt.Errorf("Unable to invite to cid '%s', not a collection I own", cid)
+	}
+	if this.IsClosed(cid) {
+		return fmt.Errorf("Unable to invite to cid '%s', it's closed", cid)
+	}
+	id, ok := this.friendId(friend)
+	if !ok {
+		return fmt.Errorf("Unable to invite to cid '%s', no such friend", cid)
+	}
+	this.Db.Exec(`REPLACE INTO Invite (friend_id, topic, outgoing, role, state, created)
+		VALUES (?, ?, 1, ?, ?, ?)`, id, cid, role, InvitePending, time.Now().Unix())
+	this.putInvite(friend, cid, role, InvitePending)
+	return nil
+}
+
+// Accepts or rejects an invite from a friend, accepting subscribes to the collection
+func (this *MetaMgr) AnswerInvite(friend *crypto.Digest, cid string, accept bool) error {
+	id, ok := this.friendId(friend)
+	if !ok {
+		return fmt.Errorf("Unable to answer invite to cid '%s', no such friend", cid)
+	}
+	var role int
+	row := this.Db.SingleQuery(`SELECT role FROM Invite
+		WHERE friend_id = ? AND topic = ? AND outgoing = 0 AND state = ?`, id, cid, InvitePending)
+	if !this.Db.MaybeScan(row, &role) {
+		return fmt.Errorf("Unable to answer invite to cid '%s', no such invite", cid)
+	}
+	state := InviteRejected
+	if accept {
+		state = InviteAccepted
+		this.Subscribe(friend, cid, true)
+	}
+	this.Db.Exec("UPDATE Invite SET state = ? WHERE friend_id = ? AND topic = ? AND outgoing = 0",
+		state, id, cid)
+	this.putInvite(friend, cid, role, state)
+	return nil
+}
+
+// Gets every invite, sent and received, newest first
+func (this *MetaMgr) GetInvites() []*Invite {
+	rows := this.Db.MultiQuery(`
+		SELECT f.fingerprint, i.topic, i.role, i.state, i.outgoing, i.created
+		FROM Invite i, Friend f
+		WHERE i.friend_id = f.id
+		ORDER BY i.created DESC`)
+	out := []*Invite{}
+	for rows.Next() {
+		var fpBytes []byte
+		var created int64
+		invite := &Invite{}
+		this.Db.Scan(rows, &fpBytes, &invite.Cid, &invite.Role, &invite.State, &invite.Outgoing, &created)
+		if transfer.DecodeBytes(fpBytes, &invite.Friend) != nil {
+			continue
+		}
+		invite.Created = time.Unix(created, 0)
+		out = append(out, invite)
+	}
+	return out
+}
+
+func (this *MetaMgr) onInvite(who int, remote *crypto.Digest, rec *sync.Record) {
+	this.Log.Printf("Processing Invite")
+
+	// Only invites from the friend's outbox to me count
+	if rec.Topic != this.InboxTopic(remote) {
+		this.Log.Printf("Invite from the wrong topic, ignoring")
+		return
+	}
+	var mesg *inviteMesg
+	err := transfer.DecodeBytes(rec.Value, &mesg)
+	if err != nil || !mesg.Key.Fingerprint().Equal(remote) {
+		this.Log.Printf("Invite record is misformed, ignoring")
+		return
+	}
+	cid := rec.Key
+
+	// An offer to me, replaces any earlier one
+	if mesg.State == InvitePending {
+		if mesg.Role != RoleReader && mesg.Role != RoleWriter {
+			this.Log.Printf("Invite has an unknown role, ignoring")
+			return
+		}
+		this.Db.Exec(`REPLACE INTO Invite (friend_id, topic, outgoing, role, state, created)
+			VALUES (?, ?, 0, ?, ?, ?)`, who, cid, mesg.Role, InvitePending, time.Now().Unix())
+		return
+	}
+
+	// An answer to my offer, which must still be pending
+	if mesg.State != InviteAccepted && mesg.State != InviteRejected {
+		this.Log.Printf("Invite has an unknown state, ignoring")
+		return
+	}
+	var role int
+	row := this.Db.SingleQuery(`SELECT role FROM Invite
+		WHERE friend_id = ? AND topic = ? AND outgoing = 1 AND state = ?`, who, cid, InvitePending)
+	if !this.Db.MaybeScan(row, &role) {
+		this.Log.Printf("Answer to an unknown invite, ignoring")
+		return
+	}
+	this.Db.Exec("UPDATE Invite SET state = ? WHERE friend_id = ? AND topic = ? AND outgoing = 1",
+		mesg.State, who, cid)
+	if mesg.State != InviteAccepted {
+		return
+	}
+	if this.IsPrivate(cid) {
+		err = this.AddReader(cid, this.Ident, mesg.Key)
+		if err != nil {
+			this.Log.Printf("Unable to add reader for invite: %s", err)
+		}
+	}
+	if role == RoleWriter {
+		this.AddWriter(cid, this.Ident, mesg.Key)
+	}
+	// Sync only sends a topic to friends I'm subscribed to it with, so without this they
+	// would never get the collection, nor I what they write
+	this.Subscribe(remote, cid, true)
+}
+
+// Forgets the invites of friends who are removed
+func (this *MetaMgr) onInviteFriend(id int, fp *crypto.Digest, what link.FriendStatus) {
+	if what == link.FriendRemoved {
+		this.Db.Exec("DELETE FROM Invite WHERE friend_id = ?", id)
+	}
+}
@@ -0,0 +1,111 @@
+package meta
+
+import (
+	"h0tb0x/sync"
+)
+
+// How many keys an iterator reads at once
+const iteratorPage = 100
+
+// Iterates over the data of a collection in key order.  Each key has the latest value,
+// as Get picks it, and deleted keys and ones I can't read are skipped.  Keys are
+// read a page at a time, so no query is left open, and changes while iterating may be seen.
+type Iterator struct {
+	meta   *MetaMgr
+	cid    string
+	prefix string
+	from   string   // The next key to read, inclusive
+	page   []string // Keys read but not yet returned
+	done   bool     // Nothing left to read
+	key    string
+	value  []byte
+	author string
+}
+
+// Iterates over the keys of a collection starting with prefix
+func (this *MetaMgr) Iterate(cid string, prefix string) *Iterator {
+	return &Iterator{meta: this, cid: cid, prefix: prefix, from: prefix}
+}
+
+// Gets every key starting with prefix and its value
+func (this *MetaMgr) GetAll(cid string, prefix string) map[string][]byte {
+	out := make(map[string][]byte)
+	it := this.Iterate(cid, prefix)
+	for it.Next() {
+		out[it.Key()] = it.Value()
+	}
+	return out
+}
+
+// Moves to the first key at or after key, the next call to Next returns it
+func (this *Iterator) Seek(key string) {
+	if key < this.prefix {
+		key = this.prefix
+	}
+	this.from = key
+	this.page = nil
+	this.done = false
+}
+
+func (this *Iterator) fetch() {
+	query := "SELECT DISTINCT key FROM Object WHERE topic = ? AND type = ? AND key >= ?"
+	args := []interface{}{this.cid, sync.RTData, this.from}
+	if end := PrefixEnd(this.prefix); end != "" {
+		query += " AND key < ?"
+		args = append(args, end)
+	}
+	args = append(args, iteratorPage)
+	rows := this.meta.Db.MultiQuery(query+" ORDER BY key LIMIT ?", args...)
+	for rows.Next() {
+		var key string
+		this.meta.Db.Scan(rows, &key)
+		this.page = append(this.page, key)
+	}
+	if len(this.page) < iteratorPage {
+		this.done = true
+	} else {
+		this.from = this.page[len(this.page)-1] + "\x00"
+	}
+}
+
+// Moves to the next key, returns false at the end
+func (this *Iterator) Next() bool {
+	for {
+		if len(this.page) == 0 {
+			if this.done {
+				return false
+			}
+			this.fetch()
+			continue
+		}
+		key := this.page[0]
+		this.page = this.page[1:]
+		rec := this.meta.SyncMgr.Get(sync.RTData, this.cid, key)
+		if rec == nil {
+			continue
+		}
+		value := this.meta.openValue(this.cid, rec.Value)
+		if value == nil {
+			continue
+		}
+		this.key = key
+		this.value = value
+		this.author = rec.Author
+		return true
+	}
+}
+
+// The key moved to
+func (this *Iterator) Key() string {
+	return this.key
+}
+
+// The plaintext of the value
+func (this *Iterator) Value() []byte {
+	return this.value
+}
+
+// The fingerprint of the writer of the value
+func (this *Iterator) Author() string {
+	return this.author
+}
@@ -12,9 +12,15 @@ import (
 
 type MetaMgrCallback func(string, string, []byte, string, bool)
 
+// Called with the cid of a collection when it's closed
+type MetaMgrCloseCallback func(string)
+
 type MetaMgr struct {
 	*sync.SyncMgr
-	callbacks []MetaMgrCallback
+	callbacks         []MetaMgrCallback
+	closeCallbacks    []MetaMgrCloseCallback
+	historyCallbacks  []MetaMgrCallback
+	conflictCallbacks []MetaMgrCallback
 }
 
 type collectionBasis struct {
@@ -22,15 +28,65 @@ type collectionBasis struct {
 	Owner *crypto.PublicIdentity
 }
 
-func signRecord(rec *sync.Record, writer *crypto.SecretIdentity) {
-	hash := crypto.HashOf(rec.RecordType, rec.Topic, rec.Key, rec.Value, rec.Priority)
+// The value of a reader record, every generation of the collection key wrapped to the reader
+type readerKeys struct {
+	Reader *crypto.PublicIdentity
+	Keys   []*crypto.EncryptedKey
+}
+
+// The value of a data record in a private collection
+type sealedValue struct {
+	Generation int
+	Data       []byte
+}
+
+// Encrypts a data value with the latest generation of the key
+func seal(keys []*crypto.SymmetricKey, data []byte) []byte {
+	gen := len(keys) - 1
+	return transfer.AsBytes(&sealedValue{
+		Generation: gen,
+		Data:       keys[gen].EncryptBytes(data),
+	})
+}
+
+// Decrypts a data value, returns nil if it can't be decrypted
+func unseal(keys []*crypto.SymmetricKey, value []byte) []byte {
+	var sv *sealedValue
+	err := transfer.DecodeBytes(value, &sv)
+	if err != nil || sv.Generation < 0 || sv.Generation >= len(keys) {
+		return nil
+	}
+	data, err := keys[sv.Generation].DecryptBytes(sv.Data)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// Records from before clocks are signed without one
+func recordHash(rec *sync.Record) *crypto.Digest {
+	if rec.Clock == 0 {
+		return crypto.HashOf(rec.RecordType, rec.Topic, rec.Key, rec.Value, rec.Priority)
+	}
+	return crypto.HashOf(rec.RecordType, rec.Topic, rec.Key, rec.Value, rec.Priority, rec.Clock)
+}
+
+// Stamps a record with a new clock and signs it.  The clock is after the record it
+// replaces, even if that one's clock is ahead of mine, so the write always wins.
+func (this *MetaMgr) signRecord(rec *sync.Record, writer *crypto.SecretIdentity) {
+	rec.Clock = this.SyncMgr.Now()
+	cur := this.SyncMgr.Get(rec.RecordType, rec.Topic, rec.Key)
+	if cur != nil && cur.Clock >= rec.Clock {
+		rec.Clock = cur.Clock + 1
+	}
+	hash := recordHash(rec)
 	sig := writer.Sign(hash)
 	rec.Author = writer.Fingerprint().String()
 	rec.Signature = transfer.AsBytes(sig)
 }
 
 func verifyRecord(rec *sync.Record, writer *crypto.PublicIdentity) bool {
-	hash := crypto.HashOf(rec.RecordType, rec.Topic, rec.Key, rec.Value, rec.Priority)
+	hash := recordHash(rec)
 	var sig *crypto.Signature
 	err := transfer.DecodeBytes(rec.Signature, &sig)
 	if err != nil {
@@ -48,11 +104,18 @@ func (this *MetaMgr) AddCallback(callback MetaMgrCallback) {
 	this.callbacks = append(this.callbacks, callback)
 }
 
+func (this *MetaMgr) AddCloseCallback(callback MetaMgrCloseCallback) {
+	this.closeCallbacks = append(this.closeCallbacks, callback)
+}
+
 // Run the MetaMgr, starts sync as well
 func (this *MetaMgr) Start() {
 	this.SyncMgr.SetSink(sync.RTBasis, this.onBasis)
 	this.SyncMgr.SetSink(sync.RTWriter, this.onWriter)
 	this.SyncMgr.SetSink(sync.RTData, this.onData)
+	this.SyncMgr.SetSink(sync.RTReader, this.onReader)
+	this.SyncMgr.SetSink(sync.RTInvite, this.onInvite)
+	this.SyncMgr.AddListener(this.onInviteFriend)
 	this.SyncMgr.Start()
 	this.CreateSpecialCollection(this.Ident, this.Ident.Fingerprint())
 	this.CreateSpecialCollection(this.Ident, crypto.HashOf("profile"))
@@ -92,7 +155,7 @@ func (this *MetaMgr) CreateSpecialCollection(owner *crypto.SecretIdentity, uniq
 		Author:     pubkey.Fingerprint().String(),
 		Value:      transfer.AsBytes(cb),
 	}
-	signRecord(basis, owner)
+	this.signRecord(basis, owner)
 	this.SyncMgr.Put(basis)
 
 	owr := &sync.Record{
@@ -101,12 +164,180 @@ func (this *MetaMgr) CreateSpecialCollection(owner *crypto.SecretIdentity, uniq
 		Key:        pubkey.Fingerprint().String(),
 		Value:      transfer.AsBytes(pubkey),
 	}
-	signRecord(owr, owner)
+	this.signRecord(owr, owner)
 	this.SyncMgr.Put(owr)
 
 	return
 }
 
+// Creates a new private collection, data in it can only be read by readers, initially just the owner
+func (this *MetaMgr) CreatePrivateCollection(owner *crypto.SecretIdentity) (cid string) {
+	cid = this.CreateNewCollection(owner)
+	this.putReader(cid, owner, owner.Public(), []*crypto.SymmetricKey{crypto.NewSymmetricKey()})
+	return
+}
+
+// Checks if a collection is private, that is, if the owner is a reader
+func (this *MetaMgr) IsPrivate(cid string) bool {
+	owner := this.GetOwner(cid)
+	if owner == nil {
+		return false
+	}
+	return this.SyncMgr.Get(sync.RTReader, cid, owner.Fingerprint().String()) != nil
+}
+
+// Gets every generation of the key of a private collection, nil if the collection is public,
+// or if reader isn't allowed to read it
+func (this *MetaMgr) GetKeys(cid string, reader *crypto.SecretIdentity) []*crypto.SymmetricKey {
+	rec := this.SyncMgr.Get(sync.RTReader, cid, reader.Fingerprint().String())
+	if rec == nil || len(rec.Value) == 0 {
+		return nil
+	}
+	var rk *readerKeys
+	err := transfer.DecodeBytes(rec.Value, &rk)
+	if err != nil {
+		this.Log.Printf("Unable to decode reader record: %s", err)
+		return nil
+	}
+	keys := []*crypto.SymmetricKey{}
+	for _, ek := range rk.Keys {
+		keys = append(keys, reader.Decrypt(ek))
+	}
+	return keys
+}
+
+// Gets the readers of a private collection
+func (this *MetaMgr) GetReaders(cid string) []*crypto.PublicIdentity {
+	rows := this.Db.MultiQuery("SELECT value FROM Object WHERE topic = ? AND type = ?",
+		cid, sync.RTReader)
+	out := []*crypto.PublicIdentity{}
+	for rows.Next() {
+		var value []byte
+		this.Db.Scan(rows, &value)
+		if len(value) == 0 {
+			continue
+		}
+		var rk *readerKeys
+		if transfer.DecodeBytes(value, &rk) == nil {
+			out = append(out, rk.Reader)
+		}
+	}
+	return out
+}
+
+// Wraps every generation of the key to a reader and publishes it
+func (this *MetaMgr) putReader(cid string, owner *crypto.SecretIdentity, reader *crypto.PublicIdentity, keys []*crypto.SymmetricKey) {
+	rk := &readerKeys{Reader: reader}
+	for _, key := range keys {
+		rk.Keys = append(rk.Keys, reader.Encrypt(key))
+	}
+	rec := &sync.Record{
+		RecordType: sync.RTReader,
+		Topic:      cid,
+		Key:        reader.Fingerprint().String(),
+		Value:      transfer.AsBytes(rk),
+	}
+	old := this.SyncMgr.Get(sync.RTReader, cid, rec.Key)
+	if old != nil {
+		rec.Priority = old.Priority + 1
+	}
+	this.signRecord(rec, owner)
+	this.storeReader(rec)
+}
+
+// Adds a reader to a private collection, the reader gets every generation of the key
+func (this *MetaMgr) AddReader(cid string, owner *crypto.SecretIdentity, reader *crypto.PublicIdentity) error {
+	keys := this.GetKeys(cid, owner)
+	if keys == nil {
+		return fmt.Errorf("Unable to add reader to cid '%s', not a private collection I own", cid)
+	}
+	// If no change, leave alone
+	rec := this.SyncMgr.Get(sync.RTReader, cid, reader.Fingerprint().String())
+	if rec != nil && len(rec.Value) > 0 {
+		var rk *readerKeys
+		if transfer.DecodeBytes(rec.Value, &rk) == nil && len(rk.Keys) == len(keys) {
+			return nil
+		}
+	}
+	this.putReader(cid, owner, reader, keys)
+	return nil
+}
+
+// Removes a reader by key, and rotates the key of the collection so they can't read new data
+func (this *MetaMgr) RemoveReader(cid string, owner *crypto.SecretIdentity, key string) error {
+	keys := this.GetKeys(cid, owner)
+	if keys == nil {
+		return fmt.Errorf("Unable to remove reader from cid '%s', not a private collection I own", cid)
+	}
+	if key == owner.Fingerprint().String() {
+		return fmt.Errorf("Unable to remove the owner of cid '%s' as a reader", cid)
+	}
+	rec := this.SyncMgr.Get(sync.RTReader, cid, key)
+	if rec == nil || len(rec.Value) == 0 {
+		return nil
+	}
+	rec.Value = []byte{}
+	rec.Priority = rec.Priority + 1
+	this.signRecord(rec, owner)
+	this.storeReader(rec)
+
+	// Hand a new key to everyone who is left
+	keys = append(keys, crypto.NewSymmetricKey())
+	for _, reader := range this.GetReaders(cid) {
+		this.putReader(cid, owner, reader, keys)
+	}
+	return nil
+}
+
+// Stores a reader record.  If it changes whether I can read the collection, the data is
+// replayed to the callbacks, since they only hear about data I can read.
+func (this *MetaMgr) storeReader(rec *sync.Record) {
+	if rec.Key != this.Ident.Fingerprint().String() {
+		this.SyncMgr.Put(rec)
+		return
+	}
+	before := this.GetKeys(rec.Topic, this.Ident) != nil
+	after := len(rec.Value) > 0
+	if before && !after {
+		this.replayData(rec.Topic, false)
+	}
+	this.SyncMgr.Put(rec)
+	if !before && after {
+		this.replayData(rec.Topic, true)
+	}
+}
+
+// Sends the current value of every key in a collection to the callbacks
+func (this *MetaMgr) replayData(cid string, isUp bool) {
+	rows := this.Db.MultiQuery("SELECT DISTINCT key FROM Object WHERE topic = ? AND type = ?",
+		cid, sync.RTData)
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		this.Db.Scan(rows, &key)
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		rec := this.SyncMgr.Get(sync.RTData, cid, key)
+		this.signalData(cid, rec.Key, rec.Value, rec.Author, isUp)
+	}
+}
+
+// Gets the plaintext of a data value, nil if it's a tombstone or I'm unable to read it
+func (this *MetaMgr) openValue(cid string, value []byte) []byte {
+	if len(value) == 0 {
+		return nil
+	}
+	if !this.IsPrivate(cid) {
+		return value
+	}
+	keys := this.GetKeys(cid, this.Ident)
+	if keys == nil {
+		return nil
+	}
+	return unseal(keys, value)
+}
+
 // Removes a writer by key
 func (this *MetaMgr) RemoveWriter(cid string, owner *crypto.SecretIdentity, key string) {
 	rec := this.SyncMgr.Get(sync.RTWriter, cid, key)
@@ -118,7 +349,7 @@ func (this *MetaMgr) RemoveWriter(cid string, owner *crypto.SecretIdentity, key
 	}
 	rec.Value = []byte{}
 	rec.Priority = rec.Priority + 1
-	signRecord(rec, owner)
+	this.signRecord(rec, owner)
 	this.SyncMgr.Put(rec)
 }
 
@@ -148,7 +379,7 @@ func (this *MetaMgr) AddWriter(cid string, owner *crypto.SecretIdentity, writer
 		Priority:   priority,
 		Value:      newValue,
 	}
-	signRecord(wrr, owner)
+	this.signRecord(wrr, owner)
 	this.SyncMgr.Put(wrr)
 }
 
@@ -158,40 +389,110 @@ func (this *MetaMgr) doCallbacks(cid string, key string, data []byte, author str
 	}
 }
 
-// Writes meta-data, may fail if cid does not exist, or writer is not allowed
-func (this *MetaMgr) Put(cid string, writer *crypto.SecretIdentity, key string, data []byte) error {
+// Passes a data value to the callbacks, if I'm able to read it
+func (this *MetaMgr) signalData(cid string, key string, value []byte, author string, isUp bool) {
+	data := this.openValue(cid, value)
+	if data == nil {
+		return
+	}
+	this.doCallbacks(cid, key, data, author, isUp)
+}
+
+// Stores a data record, callbacks only hear about the winning record of each key, so
+// if the winner changes the old one goes down and the new one comes up
+func (this *MetaMgr) storeData(rec *sync.Record) {
+	old := this.SyncMgr.Get(sync.RTData, rec.Topic, rec.Key)
+	this.SyncMgr.Put(rec)
+	// Siblings go down last, so a value which was one never stops being held
+	defer this.dropSiblings(this.updateConflict(rec.Topic, rec.Key))
+	cur := this.SyncMgr.Get(sync.RTData, rec.Topic, rec.Key)
+	if old != nil && old.Author == cur.Author && sync.CompareVersions(old, cur) == 0 &&
+		bytes.Equal(old.Value, cur.Value) {
+		return
+	}
+	if old != nil {
+		// Kept before it goes down, so what it refers to is never dropped
+		this.keepVersion(old)
+		this.signalData(old.Topic, old.Key, old.Value, old.Author, false)
+	}
+	this.signalData(cur.Topic, cur.Key, cur.Value, cur.Author, true)
+}
+
+// Signs and stores a new data record, later than any existing one.  Its priority is above
+// every writer's, not just the current one's, so a write which has seen the others never
+// ties with them, and one which hasn't does.
+func (this *MetaMgr) putData(cid string, writer *crypto.SecretIdentity, key string, value []byte) {
+	row := this.Db.SingleQuery(`
+		SELECT IFNULL(MAX(priority)+1, 0) FROM Object WHERE topic = ? AND type = ? AND key = ?`,
+		cid, sync.RTData, key)
+	var priority int
+	this.Db.Scan(row, &priority)
+	rec := &sync.Record{
+		RecordType: sync.RTData,
+		Topic:      cid,
+		Key:        key,
+		Value:      value,
+		Priority:   priority,
+		Author:     writer.Public().Fingerprint().String(),
+	}
+	this.signRecord(rec, writer)
+	this.storeData(rec)
+}
+
+// Checks that a writer is allowed to modify a collection
+func (this *MetaMgr) checkWriter(cid string, writer *crypto.SecretIdentity) error {
 	basisRec := this.SyncMgr.Get(sync.RTBasis, cid, "$")
 	if basisRec == nil {
 		return fmt.Errorf("Unable to write to cid '%s', doesn't exist!", cid)
 	}
+	if this.IsClosed(cid) {
+		return fmt.Errorf("Unable to write to cid '%s', it's closed", cid)
+	}
 	myFingerprint := writer.Public().Fingerprint().String()
 	myPerm := this.SyncMgr.Get(sync.RTWriter, cid, myFingerprint)
 	if myPerm == nil {
 		return fmt.Errorf("Unable to write to cid '%s', '%s' doesn't have permission", cid, myFingerprint)
 	}
-	old := this.SyncMgr.Get(sync.RTData, cid, key)
-	priority := 0
-	if old != nil {
-		priority = old.Priority + 1
+	return nil
+}
+
+// Writes meta-data, may fail if cid does not exist, or writer is not allowed
+func (this *MetaMgr) Put(cid string, writer *crypto.SecretIdentity, key string, data []byte) error {
+	err := this.checkWriter(cid, writer)
+	if err != nil {
+		return err
 	}
-	rec := &sync.Record{
-		RecordType: sync.RTData,
-		Topic:      cid,
-		Key:        key,
-		Value:      data,
-		Priority:   priority,
-		Author:     myFingerprint,
+	if len(data) == 0 {
+		return fmt.Errorf("Unable to write to cid '%s', empty values are reserved for deletes", cid)
 	}
-	signRecord(rec, writer)
-	if old != nil {
-		this.doCallbacks(cid, key, old.Value, myFingerprint, false)
+	value := data
+	if this.IsPrivate(cid) {
+		keys := this.GetKeys(cid, writer)
+		if keys == nil {
+			return fmt.Errorf("Unable to write to cid '%s', '%s' isn't a reader", cid,
+				writer.Public().Fingerprint().String())
+		}
+		value = seal(keys, data)
 	}
-	this.SyncMgr.Put(rec)
-	this.doCallbacks(cid, key, data, myFingerprint, true)
+	this.putData(cid, writer, key, value)
+	return nil
+}
+
+// Deletes a key by writing a tombstone (an empty value) over it
+func (this *MetaMgr) Delete(cid string, writer *crypto.SecretIdentity, key string) error {
+	err := this.checkWriter(cid, writer)
+	if err != nil {
+		return err
+	}
+	old := this.SyncMgr.Get(sync.RTData, cid, key)
+	if old == nil || len(old.Value) == 0 {
+		return fmt.Errorf("Unable to delete '%s' from cid '%s', no such key", key, cid)
+	}
+	this.putData(cid, writer, key, []byte{})
 	return nil
 }
 
-// Gets the entry (if any) with the largest priority, nil if no entry
+// Gets the latest entry (if any), nil if no entry, if it was deleted, or if I can't read it
 func (this *MetaMgr) Get(cid string, key string) []byte {
 	// Grab Lock
 	rec := this.SyncMgr.Get(sync.RTData, cid, key)
@@ -200,7 +501,16 @@ func (this *MetaMgr) Get(cid string, key string) []byte {
 	if rec == nil {
 		return nil
 	}
-	return rec.Value
+	return this.openValue(cid, rec.Value)
+}
+
+// Gets the fingerprint of the writer of the current entry for a key, empty if there is none
+func (this *MetaMgr) GetDataAuthor(cid string, key string) string {
+	rec := this.SyncMgr.Get(sync.RTData, cid, key)
+	if rec == nil || len(rec.Value) == 0 {
+		return ""
+	}
+	return rec.Author
 }
 
 // Checks if basis record is valid, if so, returns owner ID, otherwise nil
@@ -229,13 +539,13 @@ func (this *MetaMgr) verifyUpdate(rec *sync.Record, signer *crypto.PublicIdentit
 	curRec := this.SyncMgr.GetAuthor(rec.RecordType, rec.Topic, rec.Key, rec.Author)
 	if curRec != nil {
 		// If my record is newer, ignore incoming
-		if curRec.Priority > rec.Priority {
+		order := sync.CompareVersions(curRec, rec)
+		if order > 0 {
 			return
 		}
-		// If my records has identical priority and bigger data or equal data ignore
-		if curRec.Priority == rec.Priority &&
-			bytes.Compare(curRec.Value, rec.Value) >= 0 {
-			this.Log.Printf("Getting dup of priority with same value, ignoring")
+		// If my records has identical version and bigger data or equal data ignore
+		if order == 0 && bytes.Compare(curRec.Value, rec.Value) >= 0 {
+			this.Log.Printf("Getting dup of version with same value, ignoring")
 			return
 		}
 	}
@@ -246,19 +556,30 @@ func (this *MetaMgr) verifyUpdate(rec *sync.Record, signer *crypto.PublicIdentit
 
 	// All checks passed, Forward to everyone and store!
 	// Grab Lock
-	if rec.RecordType == sync.RTData && curRec != nil {
-		this.doCallbacks(rec.Topic, rec.Key, curRec.Value, rec.Author, false)
+	if rec.RecordType == sync.RTReader {
+		this.storeReader(rec)
+		return
 	}
-	this.SyncMgr.Put(rec)
 	if rec.RecordType == sync.RTData {
-		this.doCallbacks(rec.Topic, rec.Key, rec.Value, rec.Author, true)
+		this.storeData(rec)
+		return
 	}
+	this.SyncMgr.Put(rec)
 	// Drop Lock
 }
 
 func (this *MetaMgr) onBasis(who int, remote *crypto.Digest, rec *sync.Record) {
 	this.Log.Printf("Processing Basis")
 
+	if rec.Key == "closed" {
+		this.onClosed(rec)
+		return
+	}
+	if rec.Key == "info" {
+		this.onInfo(rec)
+		return
+	}
+
 	curRec := this.SyncMgr.Get(sync.RTBasis, rec.Topic, "$")
 	if curRec != nil {
 		this.Log.Printf("Getting a redundant basis, ignoring")
@@ -285,6 +606,12 @@ func (this *MetaMgr) onWriter(who int, remote *crypto.Digest, rec *sync.Record)
 		return
 	}
 
+	// Removals are empty, there's no key to check
+	if len(rec.Value) == 0 {
+		this.verifyUpdate(rec, owner)
+		return
+	}
+
 	// Validate the incoming writer record is valid
 	var checkit *crypto.PublicIdentity
 	err := transfer.DecodeBytes(rec.Value, &checkit)
@@ -327,6 +654,90 @@ func (this *MetaMgr) onData(who int, remote *crypto.Digest, rec *sync.Record) {
 	this.verifyUpdate(rec, signer)
 }
 
+func (this *MetaMgr) onReader(who int, remote *crypto.Digest, rec *sync.Record) {
+	this.Log.Printf("Processing Reader")
+
+	// Verify the basis
+	basisRec := this.SyncMgr.Get(sync.RTBasis, rec.Topic, "$")
+	owner := this.decodeBasis(basisRec, false)
+	if owner == nil {
+		this.Log.Printf("Getting record before basis, ignoring")
+		return
+	}
+
+	// Validate the incoming reader record is valid, an empty one is a removal
+	if len(rec.Value) > 0 {
+		var checkit *readerKeys
+		err := transfer.DecodeBytes(rec.Value, &checkit)
+		if err != nil {
+			this.Log.Printf("Reader record is misformed: %s", err)
+			return
+		}
+		if checkit.Reader.Fingerprint().String() != rec.Key {
+			this.Log.Printf("Reader record is misformed, key != hash")
+			return
+		}
+	}
+	this.verifyUpdate(rec, owner)
+}
+
+func (this *MetaMgr) onClosed(rec *sync.Record) {
+	owner := this.GetOwner(rec.Topic)
+	if owner == nil {
+		this.Log.Printf("Getting close before basis, ignoring")
+		return
+	}
+	if this.IsClosed(rec.Topic) {
+		this.Log.Printf("Getting a redundant close, ignoring")
+		return
+	}
+	if rec.Author != owner.Fingerprint().String() || !verifyRecord(rec, owner) {
+		this.Log.Printf("Close failed to verify, ignoring")
+		return
+	}
+	this.closeCollection(rec)
+}
+
+// Closes a collection for good, it's removed from everyone sharing it
+func (this *MetaMgr) CloseCollection(cid string, owner *crypto.SecretIdentity) error {
+	curOwner := this.GetOwner(cid)
+	if curOwner == nil || curOwner.Fingerprint().String() != owner.Fingerprint().String() {
+		return fmt.Errorf("Unable to close cid '%s', not a collection I own", cid)
+	}
+	if this.IsClosed(cid) {
+		return fmt.Errorf("Unable to close cid '%s', already closed", cid)
+	}
+	rec := &sync.Record{
+		RecordType: sync.RTBasis,
+		Topic:      cid,
+		Key:        "closed",
+		Value:      []byte{1},
+	}
+	this.signRecord(rec, owner)
+	this.closeCollection(rec)
+	return nil
+}
+
+// Checks if a collection has been closed by its owner
+func (this *MetaMgr) IsClosed(cid string) bool {
+	return this.SyncMgr.Get(sync.RTBasis, cid, "closed") != nil
+}
+
+// Stores a close, and purges everything but the basis records, which remain to tell
+// others the collection is closed
+func (this *MetaMgr) closeCollection(rec *sync.Record) {
+	cid := rec.Topic
+	this.replayData(cid, false)
+	this.dropHistory(cid)
+	this.dropConflicts(cid)
+	this.SyncMgr.Put(rec)
+	this.Db.Exec("DELETE FROM Object WHERE topic = ? AND type != ?", cid, sync.RTBasis)
+	for _, cb := range this.closeCallbacks {
+		cb(cid)
+	}
+	this.SyncMgr.UnsubscribeAll(cid)
+}
+
 func (this *MetaMgr) GetOwner(cid string) *crypto.PublicIdentity {
 	basisRec := this.SyncMgr.Get(sync.RTBasis, cid, "$")
 	if basisRec == nil {
@@ -349,5 +760,21 @@ func (this *MetaMgr) GetWriter(cid string, writer string) *crypto.PublicIdentity
 	return writerKey
 }
 
-// TODO: Add lots more functions, such as 'ListWriters' and 'GetAll', etc.
-// Also, I need to have a way to delete collections
+// Gets the current writers of a collection, in order of fingerprint, removed writers are skipped
+func (this *MetaMgr) ListWriters(cid string) []*crypto.PublicIdentity {
+	rows := this.Db.MultiQuery("SELECT DISTINCT key FROM Object WHERE topic = ? AND type = ? ORDER BY key",
+		cid, sync.RTWriter)
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		this.Db.Scan(rows, &key)
+		keys = append(keys, key)
+	}
+	out := []*crypto.PublicIdentity{}
+	for _, key := range keys {
+		if writer := this.GetWriter(cid, key); writer != nil {
+			out = append(out, writer)
+		}
+	}
+	return out
+}
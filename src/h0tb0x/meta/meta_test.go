@@ -156,3 +156,531 @@ func (this *TestMetaSuite) TestProfiles(c *C) {
 	bob.Stop()
 	carol.Stop()
 }
+
+func (this *TestMetaSuite) TestPrivate(c *C) {
+	this.C = c
+
+	// Make some users
+	alice := this.NewTestNode("A", 10001)
+	bob := this.NewTestNode("B", 10002)
+	carol := this.NewTestNode("C", 10003)
+
+	// Make a line of links, bob is in the middle
+	CreateLink(alice, bob)
+	CreateLink(bob, carol)
+
+	// Alice makes a private collection, and lets carol read and write it
+	cid := alice.meta.CreatePrivateCollection(alice.id)
+	c.Assert(alice.meta.IsPrivate(cid), Equals, true)
+	c.Assert(alice.meta.AddReader(cid, alice.id, carol.id.Public()), IsNil)
+	alice.meta.AddWriter(cid, alice.id, carol.id.Public())
+
+	// Bob can't add readers, it's not his collection
+	c.Assert(bob.meta.AddReader(cid, bob.id, bob.id.Public()), NotNil)
+
+	// Every publishes and subscribes
+	SubPub(alice, bob, cid)
+	SubPub(bob, carol, cid)
+
+	// Alice writes a record
+	c.Assert(alice.meta.Put(cid, alice.id, "Hello", []byte("World")), IsNil)
+
+	// Wait until is propagates, TODO: No races
+	time.Sleep(3 * time.Second)
+
+	// Carol can read it, bob only has the encrypted record
+	c.Assert(carol.meta.Get(cid, "Hello"), DeepEquals, []byte("World"))
+	c.Assert(bob.meta.IsPrivate(cid), Equals, true)
+	c.Assert(bob.meta.Get(cid, "Hello"), IsNil)
+	rec := bob.sync.Get(sync.RTData, cid, "Hello")
+	c.Assert(rec, NotNil)
+	c.Assert(rec.Value, Not(DeepEquals), []byte("World"))
+
+	// Carol can write too
+	c.Assert(carol.meta.Put(cid, carol.id, "Reply", []byte("Hi")), IsNil)
+	time.Sleep(3 * time.Second)
+	c.Assert(alice.meta.Get(cid, "Reply"), DeepEquals, []byte("Hi"))
+
+	// Alice removes carol, which rotates the key
+	c.Assert(alice.meta.RemoveReader(cid, alice.id, carol.id.Fingerprint().String()), IsNil)
+	c.Assert(len(alice.meta.GetKeys(cid, alice.id)), Equals, 2)
+	c.Assert(alice.meta.Put(cid, alice.id, "Secret", []byte("Stuff")), IsNil)
+	time.Sleep(3 * time.Second)
+
+	// Carol can no longer read or write
+	c.Assert(carol.meta.GetKeys(cid, carol.id), IsNil)
+	c.Assert(carol.meta.Get(cid, "Secret"), IsNil)
+	c.Assert(carol.meta.Put(cid, carol.id, "Reply", []byte("Hi")), NotNil)
+	c.Assert(alice.meta.Get(cid, "Secret"), DeepEquals, []byte("Stuff"))
+
+	// Stop everyone
+	alice.Stop()
+	bob.Stop()
+	carol.Stop()
+}
+
+func (this *TestMetaSuite) TestInvites(c *C) {
+	this.C = c
+
+	alice := this.NewTestNode("A", 10001)
+	bob := this.NewTestNode("B", 10002)
+	CreateLink(alice, bob)
+	aliceFp := alice.id.Fingerprint()
+	bobFp := bob.id.Fingerprint()
+
+	// Only the owner can invite
+	cid := alice.meta.CreatePrivateCollection(alice.id)
+	c.Assert(bob.meta.SendInvite(aliceFp, cid, RoleReader), NotNil)
+	c.Assert(alice.meta.SendInvite(bobFp, cid, RoleWriter), IsNil)
+	time.Sleep(3 * time.Second)
+
+	// Bob sees it pending, and accepts
+	invites := bob.meta.GetInvites()
+	c.Assert(invites, HasLen, 1)
+	c.Assert(invites[0].Cid, Equals, cid)
+	c.Assert(invites[0].Friend.Equal(aliceFp), Equals, true)
+	c.Assert(invites[0].Role, Equals, RoleWriter)
+	c.Assert(invites[0].State, Equals, InvitePending)
+	c.Assert(invites[0].Outgoing, Equals, false)
+	c.Assert(bob.meta.AnswerInvite(aliceFp, cid, true), IsNil)
+	c.Assert(bob.meta.AnswerInvite(aliceFp, cid, true), NotNil)
+	time.Sleep(3 * time.Second)
+
+	// Alice added him as a reader and writer
+	invites = alice.meta.GetInvites()
+	c.Assert(invites, HasLen, 1)
+	c.Assert(invites[0].Outgoing, Equals, true)
+	c.Assert(invites[0].State, Equals, InviteAccepted)
+	c.Assert(alice.meta.Put(cid, alice.id, "Hello", []byte("World")), IsNil)
+	time.Sleep(3 * time.Second)
+	c.Assert(bob.meta.Get(cid, "Hello"), DeepEquals, []byte("World"))
+	c.Assert(bob.meta.Put(cid, bob.id, "Reply", []byte("Hi")), IsNil)
+	time.Sleep(3 * time.Second)
+	c.Assert(alice.meta.Get(cid, "Reply"), DeepEquals, []byte("Hi"))
+
+	// A rejected invite grants nothing
+	other := alice.meta.CreateNewCollection(alice.id)
+	c.Assert(alice.meta.SendInvite(bobFp, other, RoleWriter), IsNil)
+	time.Sleep(3 * time.Second)
+	c.Assert(bob.meta.AnswerInvite(aliceFp, other, false), IsNil)
+	time.Sleep(3 * time.Second)
+	c.Assert(alice.meta.GetWriter(other, bobFp.String()), IsNil)
+	for _, invite := range alice.meta.GetInvites() {
+		if invite.Cid == other {
+			c.Assert(invite.State, Equals, InviteRejected)
+		}
+	}
+
+	// Readers who accept get the collection too
+	shared := alice.meta.CreateNewCollection(alice.id)
+	c.Assert(alice.meta.Put(shared, alice.id, "Hello", []byte("Reader")), IsNil)
+	c.Assert(alice.meta.SendInvite(bobFp, shared, RoleReader), IsNil)
+	time.Sleep(3 * time.Second)
+	c.Assert(bob.meta.AnswerInvite(aliceFp, shared, true), IsNil)
+	time.Sleep(3 * time.Second)
+	c.Assert(alice.meta.GetWriter(shared, bobFp.String()), IsNil)
+	c.Assert(bob.meta.Get(shared, "Hello"), DeepEquals, []byte("Reader"))
+
+	// An answer which is neither leaves the invite pending
+	third := alice.meta.CreateNewCollection(alice.id)
+	c.Assert(alice.meta.SendInvite(bobFp, third, RoleReader), IsNil)
+	time.Sleep(3 * time.Second)
+	bob.meta.putInvite(aliceFp, third, RoleReader, 7)
+	time.Sleep(3 * time.Second)
+	for _, invite := range alice.meta.GetInvites() {
+		if invite.Cid == third {
+			c.Assert(invite.State, Equals, InvitePending)
+		}
+	}
+
+	alice.Stop()
+	bob.Stop()
+}
+
+func (this *TestMetaSuite) TestInfo(c *C) {
+	this.C = c
+
+	alice := this.NewTestNode("A", 10001)
+	bob := this.NewTestNode("B", 10002)
+	CreateLink(alice, bob)
+
+	// Only the owner sets the info
+	cid := alice.meta.CreateNewCollection(alice.id)
+	secret := alice.meta.CreatePrivateCollection(alice.id)
+	c.Assert(alice.meta.GetInfo(cid), IsNil)
+	c.Assert(bob.meta.SetInfo(cid, bob.id, &CollectionInfo{Name: "Mine"}), NotNil)
+	c.Assert(alice.meta.SetInfo(cid, alice.id, &CollectionInfo{Name: "Photos"}), IsNil)
+	c.Assert(alice.meta.SetInfo(secret, alice.id, &CollectionInfo{Name: "Diary"}), IsNil)
+	created := alice.meta.GetInfo(cid).Created
+	c.Assert(created, Not(Equals), int64(0))
+	SubPub(alice, bob, cid)
+	SubPub(alice, bob, secret)
+	time.Sleep(3 * time.Second)
+	c.Assert(bob.meta.GetInfo(cid).Name, Equals, "Photos")
+	// Bob isn't a reader of the private one
+	c.Assert(bob.meta.GetInfo(secret), IsNil)
+
+	// Changes propagate, and keep the creation time
+	info := &CollectionInfo{Name: "Holiday photos", Description: "From the beach"}
+	c.Assert(alice.meta.SetInfo(cid, alice.id, info), IsNil)
+	time.Sleep(3 * time.Second)
+	info = bob.meta.GetInfo(cid)
+	c.Assert(info.Name, Equals, "Holiday photos")
+	c.Assert(info.Description, Equals, "From the beach")
+	c.Assert(info.Created, Equals, created)
+
+	alice.Stop()
+	bob.Stop()
+}
+
+func (this *TestMetaSuite) TestDelete(c *C) {
+	this.C = c
+
+	// Make some users
+	alice := this.NewTestNode("A", 10001)
+	bob := this.NewTestNode("B", 10002)
+	CreateLink(alice, bob)
+
+	// Track callbacks on bob's side
+	live := make(map[string]string)
+	bob.meta.AddCallback(func(cid, key string, data []byte, author string, isUp bool) {
+		if isUp {
+			live[key] = string(data)
+		} else {
+			delete(live, key)
+		}
+	})
+
+	// Alice makes a collection and writes a record
+	cid := alice.meta.CreateNewCollection(alice.id)
+	SubPub(alice, bob, cid)
+	c.Assert(alice.meta.Put(cid, alice.id, "Hello", []byte("World")), IsNil)
+
+	// Wait until is propagates, TODO: No races
+	time.Sleep(3 * time.Second)
+	c.Assert(bob.meta.Get(cid, "Hello"), DeepEquals, []byte("World"))
+	c.Assert(live["Hello"], Equals, "World")
+	c.Assert(bob.meta.GetDataAuthor(cid, "Hello"), Equals, alice.id.Fingerprint().String())
+
+	// Alice deletes it, deleting twice fails
+	c.Assert(alice.meta.Delete(cid, alice.id, "Hello"), IsNil)
+	c.Assert(alice.meta.Delete(cid, alice.id, "Hello"), NotNil)
+	c.Assert(alice.meta.Get(cid, "Hello"), IsNil)
+	time.Sleep(3 * time.Second)
+
+	// Bob sees the tombstone
+	c.Assert(bob.meta.Get(cid, "Hello"), IsNil)
+	c.Assert(bob.meta.GetDataAuthor(cid, "Hello"), Equals, "")
+	_, ok := live["Hello"]
+	c.Assert(ok, Equals, false)
+
+	// The key can be written again
+	c.Assert(alice.meta.Put(cid, alice.id, "Hello", []byte("Again")), IsNil)
+	time.Sleep(3 * time.Second)
+	c.Assert(bob.meta.Get(cid, "Hello"), DeepEquals, []byte("Again"))
+	c.Assert(live["Hello"], Equals, "Again")
+
+	// Stop everyone
+	alice.Stop()
+	bob.Stop()
+}
+
+func (this *TestMetaSuite) TestNamespaces(c *C) {
+	this.C = c
+	alice := this.NewTestNode("A", 10001)
+	cid := alice.meta.CreateNewCollection(alice.id)
+	for _, key := range []string{"photos/a", "photos/b", "photos/old/c", "photosx", "music/d"} {
+		c.Assert(alice.meta.Put(cid, alice.id, key, []byte(key)), IsNil)
+	}
+
+	// Renaming onto an existing key, or an overlapping prefix, fails
+	c.Assert(alice.meta.Rename(cid, alice.id, "photos/a", "photos/b"), NotNil)
+	c.Assert(alice.meta.Rename(cid, alice.id, "nothing", "photos/z"), NotNil)
+	_, err := alice.meta.RenamePrefix(cid, alice.id, "photos/", "photos/old/")
+	c.Assert(err, NotNil)
+	_, err = alice.meta.RenamePrefix(cid, alice.id, "photos/", "photos")
+	c.Assert(err, NotNil)
+
+	// Rename a single key, then a tree of them
+	c.Assert(alice.meta.Rename(cid, alice.id, "photos/a", "photos/z"), IsNil)
+	c.Assert(alice.meta.Get(cid, "photos/a"), IsNil)
+	c.Assert(alice.meta.Get(cid, "photos/z"), DeepEquals, []byte("photos/a"))
+	n, err := alice.meta.RenamePrefix(cid, alice.id, "photos/", "pics/")
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
+	c.Assert(alice.meta.Get(cid, "pics/old/c"), DeepEquals, []byte("photos/old/c"))
+	c.Assert(alice.meta.Get(cid, "photos/b"), IsNil)
+	c.Assert(alice.meta.Get(cid, "photosx"), DeepEquals, []byte("photosx"))
+
+	// Deleted keys aren't counted twice
+	n, err = alice.meta.DeletePrefix(cid, alice.id, "pics/")
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
+	n, err = alice.meta.DeletePrefix(cid, alice.id, "pics/")
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 0)
+	c.Assert(alice.meta.Get(cid, "music/d"), DeepEquals, []byte("music/d"))
+	alice.Stop()
+}
+
+func (this *TestMetaSuite) TestIterate(c *C) {
+	this.C = c
+	alice := this.NewTestNode("A", 10001)
+	bob := this.NewTestNode("B", 10002)
+	CreateLink(alice, bob)
+
+	// Alice makes a collection, bob can write it
+	cid := alice.meta.CreateNewCollection(alice.id)
+	alice.meta.AddWriter(cid, alice.id, bob.id.Public())
+	SubPub(alice, bob, cid)
+	for _, key := range []string{"a/1", "a/2", "a/3", "b/1"} {
+		c.Assert(alice.meta.Put(cid, alice.id, key, []byte(key)), IsNil)
+	}
+	c.Assert(alice.meta.Put(cid, alice.id, "a/2", []byte("again")), IsNil)
+	c.Assert(alice.meta.Delete(cid, alice.id, "a/3"), IsNil)
+
+	// Deleted keys are skipped, the latest value wins
+	all := alice.meta.GetAll(cid, "a/")
+	c.Assert(all, DeepEquals, map[string][]byte{"a/1": []byte("a/1"), "a/2": []byte("again")})
+	c.Assert(len(alice.meta.GetAll(cid, "")), Equals, 3)
+
+	// Seeking stays within the prefix
+	it := alice.meta.Iterate(cid, "a/")
+	it.Seek("a/10")
+	c.Assert(it.Next(), Equals, true)
+	c.Assert(it.Key(), Equals, "a/2")
+	c.Assert(it.Author(), Equals, alice.id.Fingerprint().String())
+	c.Assert(it.Next(), Equals, false)
+	it.Seek("")
+	c.Assert(it.Next(), Equals, true)
+	c.Assert(it.Key(), Equals, "a/1")
+
+	// Removing a writer reaches bob
+	time.Sleep(3 * time.Second)
+	c.Assert(len(bob.meta.ListWriters(cid)), Equals, 2)
+	alice.meta.RemoveWriter(cid, alice.id, bob.id.Fingerprint().String())
+	time.Sleep(3 * time.Second)
+	writers := bob.meta.ListWriters(cid)
+	c.Assert(len(writers), Equals, 1)
+	c.Assert(writers[0].Fingerprint().String(), Equals, alice.id.Fingerprint().String())
+	c.Assert(bob.meta.GetAll(cid, "b/"), DeepEquals, map[string][]byte{"b/1": []byte("b/1")})
+
+	alice.Stop()
+	bob.Stop()
+}
+
+func (this *TestMetaSuite) TestHistory(c *C) {
+	this.C = c
+	alice := this.NewTestNode("A", 10001)
+	bob := this.NewTestNode("B", 10002)
+	CreateLink(alice, bob)
+
+	// Track what bob keeps
+	kept := make(map[string]int)
+	bob.meta.AddHistoryCallback(func(cid, key string, data []byte, author string, isUp bool) {
+		if isUp {
+			kept[string(data)]++
+		} else {
+			kept[string(data)]--
+		}
+	})
+
+	// Without retention, nothing is kept
+	cid := alice.meta.CreatePrivateCollection(alice.id)
+	c.Assert(alice.meta.AddReader(cid, alice.id, bob.id.Public()), IsNil)
+	SubPub(alice, bob, cid)
+	c.Assert(alice.meta.Put(cid, alice.id, "doc", []byte("one")), IsNil)
+	c.Assert(alice.meta.Put(cid, alice.id, "doc", []byte("two")), IsNil)
+	c.Assert(alice.meta.GetHistory(cid, "doc"), HasLen, 0)
+	c.Assert(alice.meta.SetRetention(cid, -1), NotNil)
+
+	// Both sides keep their own history, as long as bob sees each value
+	time.Sleep(3 * time.Second)
+	c.Assert(alice.meta.SetRetention(cid, 2), IsNil)
+	c.Assert(bob.meta.SetRetention(cid, 2), IsNil)
+	c.Assert(alice.meta.Put(cid, alice.id, "doc", []byte("three")), IsNil)
+	time.Sleep(3 * time.Second)
+	c.Assert(alice.meta.Delete(cid, alice.id, "doc"), IsNil)
+	time.Sleep(3 * time.Second)
+	for _, node := range []*TestNode{alice, bob} {
+		history := node.meta.GetHistory(cid, "doc")
+		c.Assert(history, HasLen, 2)
+		c.Assert(history[0].Version, Equals, 2)
+		c.Assert(history[0].Value, DeepEquals, []byte("three"))
+		c.Assert(history[0].Author, Equals, alice.id.Fingerprint().String())
+		c.Assert(history[1].Value, DeepEquals, []byte("two"))
+	}
+
+	// Restoring makes a new current value, lowering retention drops old versions
+	c.Assert(alice.meta.Restore(cid, alice.id, "doc", 7), NotNil)
+	c.Assert(alice.meta.Restore(cid, alice.id, "doc", 1), IsNil)
+	c.Assert(alice.meta.Get(cid, "doc"), DeepEquals, []byte("two"))
+	c.Assert(alice.meta.GetHistory(cid, "doc"), HasLen, 2)
+	c.Assert(bob.meta.SetRetention(cid, 1), IsNil)
+	c.Assert(bob.meta.GetVersion(cid, "doc", 1), IsNil)
+	c.Assert(kept["two"], Equals, 0)
+	c.Assert(kept["three"], Equals, 1)
+
+	// Closing drops the lot
+	c.Assert(alice.meta.CloseCollection(cid, alice.id), IsNil)
+	c.Assert(alice.meta.GetHistory(cid, "doc"), HasLen, 0)
+	c.Assert(alice.meta.GetRetention(cid), Equals, 0)
+
+	alice.Stop()
+	bob.Stop()
+}
+
+func (this *TestMetaSuite) TestConflicts(c *C) {
+	this.C = c
+	alice := this.NewTestNode("A", 10001)
+	bob := this.NewTestNode("B", 10002)
+	CreateLink(alice, bob)
+
+	// Track what bob keeps
+	kept := make(map[string]int)
+	bob.meta.AddConflictCallback(func(cid, key string, data []byte, author string, isUp bool) {
+		if isUp {
+			kept[string(data)]++
+		} else {
+			kept[string(data)]--
+		}
+	})
+
+	// Both start from the same value
+	cid := alice.meta.CreateNewCollection(alice.id)
+	alice.meta.AddWriter(cid, alice.id, bob.id.Public())
+	SubPub(alice, bob, cid)
+	c.Assert(alice.meta.Put(cid, alice.id, "doc", []byte("base")), IsNil)
+	c.Assert(alice.meta.Put(cid, alice.id, "same", []byte("base")), IsNil)
+	time.Sleep(3 * time.Second)
+	c.Assert(bob.meta.Get(cid, "doc"), DeepEquals, []byte("base"))
+
+	// While they aren't talking, both change it
+	alice.sync.Subscribe(bob.id.Fingerprint(), cid, false)
+	bob.sync.Subscribe(alice.id.Fingerprint(), cid, false)
+	time.Sleep(3 * time.Second)
+	c.Assert(alice.meta.Put(cid, alice.id, "doc", []byte("alice")), IsNil)
+	c.Assert(bob.meta.Put(cid, bob.id, "doc", []byte("bob")), IsNil)
+	c.Assert(alice.meta.Put(cid, alice.id, "same", []byte("agreed")), IsNil)
+	c.Assert(bob.meta.Put(cid, bob.id, "same", []byte("agreed")), IsNil)
+	// Alice changes one twice, bob once after her, which still conflicts
+	c.Assert(alice.meta.Put(cid, alice.id, "twice", []byte("alice1")), IsNil)
+	c.Assert(alice.meta.Put(cid, alice.id, "twice", []byte("alice2")), IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(bob.meta.Put(cid, bob.id, "twice", []byte("later")), IsNil)
+	c.Assert(alice.meta.GetConflicts(cid), HasLen, 0)
+	SubPub(alice, bob, cid)
+	time.Sleep(3 * time.Second)
+
+	// Each sees both values, the current one is what Get returns, writing the same isn't a conflict
+	for _, node := range []*TestNode{alice, bob} {
+		conflicts := node.meta.GetConflicts(cid)
+		c.Assert(conflicts, HasLen, 2)
+		c.Assert(conflicts[0].Key, Equals, "doc")
+		c.Assert(conflicts[0].Siblings, HasLen, 2)
+		values := map[string]string{}
+		current := 0
+		for _, sibling := range conflicts[0].Siblings {
+			values[sibling.Author] = string(sibling.Value)
+			if sibling.Current {
+				c.Assert(node.meta.Get(cid, "doc"), DeepEquals, sibling.Value)
+				current++
+			}
+		}
+		c.Assert(values[alice.id.Fingerprint().String()], Equals, "alice")
+		c.Assert(values[bob.id.Fingerprint().String()], Equals, "bob")
+		c.Assert(current, Equals, 1)
+
+		c.Assert(conflicts[1].Key, Equals, "twice")
+		c.Assert(conflicts[1].Siblings, HasLen, 2)
+		c.Assert(node.meta.Get(cid, "twice"), DeepEquals, []byte("later"))
+		c.Assert(node.meta.GetSibling(cid, "twice", alice.id.Fingerprint().String()), DeepEquals,
+			[]byte("alice2"))
+	}
+	c.Assert(bob.meta.GetSibling(cid, "doc", alice.id.Fingerprint().String()), DeepEquals, []byte("alice"))
+	c.Assert(kept["alice"], Equals, 1)
+	c.Assert(kept["bob"], Equals, 1)
+	c.Assert(kept["alice2"], Equals, 1)
+	c.Assert(kept["later"], Equals, 1)
+
+	// Writing again resolves it everywhere, even by the writer with the lower priority
+	c.Assert(bob.meta.Put(cid, bob.id, "doc", []byte("merged")), IsNil)
+	c.Assert(bob.meta.Put(cid, bob.id, "twice", []byte("merged")), IsNil)
+	time.Sleep(3 * time.Second)
+	c.Assert(alice.meta.Get(cid, "doc"), DeepEquals, []byte("merged"))
+	c.Assert(alice.meta.Get(cid, "twice"), DeepEquals, []byte("merged"))
+	c.Assert(alice.meta.GetConflict(cid, "doc"), IsNil)
+	c.Assert(alice.meta.GetConflicts(cid), HasLen, 0)
+	c.Assert(bob.meta.GetConflicts(cid), HasLen, 0)
+	for _, count := range kept {
+		c.Assert(count, Equals, 0)
+	}
+
+	alice.Stop()
+	bob.Stop()
+}
+
+func (this *TestMetaSuite) TestClockAhead(c *C) {
+	this.C = c
+	alice := this.NewTestNode("A", 10001)
+
+	// A record stored with a clock far ahead of mine, like one from a broken writer
+	cid := alice.meta.CreateNewCollection(alice.id)
+	c.Assert(alice.meta.Put(cid, alice.id, "doc", []byte("ahead")), IsNil)
+	rec := alice.sync.Get(sync.RTData, cid, "doc")
+	rec.Clock += int64(24*time.Hour/time.Millisecond) << 16
+	alice.sync.Put(rec)
+
+	// Writing still replaces it
+	c.Assert(alice.meta.Put(cid, alice.id, "doc", []byte("now")), IsNil)
+	c.Assert(alice.meta.Get(cid, "doc"), DeepEquals, []byte("now"))
+
+	alice.Stop()
+}
+
+func (this *TestMetaSuite) TestClose(c *C) {
+	this.C = c
+
+	// Make some users
+	alice := this.NewTestNode("A", 10001)
+	bob := this.NewTestNode("B", 10002)
+	carol := this.NewTestNode("C", 10003)
+
+	// Make a line of links
+	CreateLink(alice, bob)
+	CreateLink(bob, carol)
+
+	// Alice makes a collection, bob can write it
+	cid := alice.meta.CreateNewCollection(alice.id)
+	alice.meta.AddWriter(cid, alice.id, bob.id.Public())
+	SubPub(alice, bob, cid)
+	SubPub(bob, carol, cid)
+	c.Assert(alice.meta.Put(cid, alice.id, "Hello", []byte("World")), IsNil)
+
+	// Wait until is propagates, TODO: No races
+	time.Sleep(3 * time.Second)
+	c.Assert(carol.meta.Get(cid, "Hello"), DeepEquals, []byte("World"))
+
+	// Only alice can close it
+	c.Assert(bob.meta.CloseCollection(cid, bob.id), NotNil)
+	c.Assert(alice.meta.CloseCollection(cid, alice.id), IsNil)
+	c.Assert(alice.meta.CloseCollection(cid, alice.id), NotNil)
+	time.Sleep(3 * time.Second)
+
+	// Everyone has dropped it
+	for _, node := range []*TestNode{alice, bob, carol} {
+		c.Assert(node.meta.IsClosed(cid), Equals, true)
+		c.Assert(node.meta.Get(cid, "Hello"), IsNil)
+		row := node.meta.Db.SingleQuery("SELECT COUNT(*) FROM Object WHERE topic = ? AND type != ?",
+			cid, sync.RTBasis)
+		var count int
+		node.meta.Db.Scan(row, &count)
+		c.Assert(count, Equals, 0)
+	}
+	c.Assert(bob.meta.Put(cid, bob.id, "Hello", []byte("Again")), NotNil)
+
+	// Stop everyone
+	alice.Stop()
+	bob.Stop()
+	carol.Stop()
+}
@@ -0,0 +1,84 @@
+package meta
+
+import (
+	"fmt"
+	"h0tb0x/crypto"
+	"strings"
+)
+
+// The smallest string greater than every string starting with prefix, empty if there is none
+func PrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// Gets the keys starting with prefix that have a value
+func (this *MetaMgr) liveKeys(cid string, prefix string) []string {
+	out := []string{}
+	it := this.Iterate(cid, prefix)
+	for it.Next() {
+		out = append(out, it.Key())
+	}
+	return out
+}
+
+// Deletes every key starting with prefix, returns how many were deleted
+func (this *MetaMgr) DeletePrefix(cid string, writer *crypto.SecretIdentity, prefix string) (int, error) {
+	err := this.checkWriter(cid, writer)
+	if err != nil {
+		return 0, err
+	}
+	keys := this.liveKeys(cid, prefix)
+	for _, key := range keys {
+		this.putData(cid, writer, key, []byte{})
+	}
+	return len(keys), nil
+}
+
+// Moves the value of a key to another key, which must not exist
+func (this *MetaMgr) Rename(cid string, writer *crypto.SecretIdentity, from string, to string) error {
+	data := this.Get(cid, from)
+	if data == nil {
+		return fmt.Errorf("Unable to rename '%s' in cid '%s', no such key", from, cid)
+	}
+	if this.Get(cid, to) != nil {
+		return fmt.Errorf("Unable to rename '%s' in cid '%s', '%s' exists", from, cid, to)
+	}
+	err := this.Put(cid, writer, to, data)
+	if err != nil {
+		return err
+	}
+	return this.Delete(cid, writer, from)
+}
+
+// Moves every key starting with from to start with to instead, returns how many were moved.
+// Nothing is moved if any of the new keys exist.
+func (this *MetaMgr) RenamePrefix(cid string, writer *crypto.SecretIdentity, from string, to string) (int, error) {
+	if strings.HasPrefix(from, to) || strings.HasPrefix(to, from) {
+		return 0, fmt.Errorf("Unable to rename '%s' to '%s' in cid '%s', they overlap", from, to, cid)
+	}
+	err := this.checkWriter(cid, writer)
+	if err != nil {
+		return 0, err
+	}
+	keys := this.liveKeys(cid, from)
+	for _, key := range keys {
+		newKey := to + key[len(from):]
+		if this.Get(cid, newKey) != nil {
+			return 0, fmt.Errorf("Unable to rename '%s' in cid '%s', '%s' exists", key, cid, newKey)
+		}
+	}
+	for _, key := range keys {
+		err = this.Rename(cid, writer, key, to+key[len(from):])
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(keys), nil
+}
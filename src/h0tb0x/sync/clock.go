@@ -0,0 +1,69 @@
+package sync
+
+import (
+	"time"
+)
+
+// Clocks are hybrid logical clocks, unix time in milliseconds shifted up by clockBits, plus
+// a counter which moves them on when the time doesn't.  They never go backwards, and are
+// after every clock heard of, so a value written after seeing another is always later.
+const clockBits = 16
+
+// Clocks further ahead of my time than this are taken to be wrong, records with them are refused
+const MaxClockDrift = time.Hour
+
+func physicalClock(t time.Time) int64 {
+	return (t.UnixNano() / int64(time.Millisecond)) << clockBits
+}
+
+// Gets a new clock, later than any given out or heard of before
+func (this *SyncMgr) Now() int64 {
+	this.clockLock.Lock()
+	defer this.clockLock.Unlock()
+	now := physicalClock(time.Now())
+	if now > this.lastClock {
+		this.lastClock = now
+	} else {
+		this.lastClock++
+	}
+	return this.lastClock
+}
+
+// The latest clock believed, anything after it is too far ahead
+func maxClock() int64 {
+	return physicalClock(time.Now().Add(MaxClockDrift))
+}
+
+// Moves my clock up to one heard from a friend, returns false if it's too far ahead
+func (this *SyncMgr) observeClock(clock int64) bool {
+	this.clockLock.Lock()
+	defer this.clockLock.Unlock()
+	if clock > maxClock() {
+		return false
+	}
+	if clock > this.lastClock {
+		this.lastClock = clock
+	}
+	return true
+}
+
+// Orders two versions of a record by clock, then priority, then author, returns 1 if lhs
+// is later, -1 if rhs is, and 0 if neither.  Records from before clocks have a clock of 0,
+// so any later one wins over them, and among themselves they go by priority.
+func CompareVersions(lhs *Record, rhs *Record) int {
+	switch {
+	case lhs.Clock > rhs.Clock:
+		return 1
+	case lhs.Clock < rhs.Clock:
+		return -1
+	case lhs.Priority > rhs.Priority:
+		return 1
+	case lhs.Priority < rhs.Priority:
+		return -1
+	case lhs.Author > rhs.Author:
+		return 1
+	case lhs.Author < rhs.Author:
+		return -1
+	}
+	return 0
+}
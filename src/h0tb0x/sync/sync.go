@@ -2,6 +2,7 @@ package sync
 
 import (
 	"bytes"
+	"fmt"
 	"h0tb0x/base"
 	"h0tb0x/crypto"
 	"h0tb0x/link"
@@ -15,8 +16,8 @@ import (
 // Topic, Key, Author, and RecordType. Topic determines who cares, RecordType allows multiple
 // 'namespaces' within the topic, and Key is the rest of the key. Multiple authors may disagree
 // about the value, thus we allow one value per author. The value also has a primary part (Value),
-// along with Priority to help disambiguate.  The Signature allows cryptographic validation of the
-// Author if set.
+// along with Clock and Priority to help disambiguate.  The Signature allows cryptographic validation
+// of the Author if set.
 type Record struct {
 	RecordType int    // A namespacing mechanism for keys.
 	Topic      string // Basis for subscriptions, defines who is interested in this record.
@@ -25,6 +26,7 @@ type Record struct {
 	Priority   int    // A mechanism to disambiguate multiple records with the same key
 	Author     string // The Fingerprint of the Author that generated this value
 	Signature  []byte // The signature from the author
+	Clock      int64  // When the value was written, from SyncMgr.Now, 0 for records from before clocks
 }
 
 const (
@@ -33,6 +35,8 @@ const (
 	RTWriter    = 2 // Used by the meta-data layer to manage writer
 	RTData      = 3 // Used by the meta-data layer to manage meta-data
 	RTAdvert    = 4 // Used by the data layer to manage storage
+	RTReader    = 5 // Used by the meta-data layer to manage readers of private collections
+	RTInvite    = 6 // Used by the meta-data layer to offer collections to friends
 )
 
 type dataMesg struct {
@@ -104,23 +108,24 @@ func (this *clientLooper) notifyLoop() {
 	for !this.isClosing() {
 		this.sync.Log.Printf("Looking for things to notify\n")
 		sql := `
-			SELECT o.topic, o.seqno, o.key, o.value, o.type, o.author, o.priority, o.signature
+			SELECT o.topic, o.seqno, o.key, o.value, o.type, o.author, o.priority, o.signature, o.clock
 			FROM Object o, TopicFriend tf
 				WHERE o.topic = tf.topic AND
 				tf.friend_id = ? AND
-				tf.desired = 1 AND tf.requested = 1 AND
+				(tf.desired = 1 OR o.type = ?) AND tf.requested = 1 AND
 				o.seqno > tf.acked_seqno
 			ORDER BY o.seqno
 			LIMIT 100`
 
-		rows := this.sync.Db.MultiQuery(sql, this.friendId)
+		// Basis records are sent even if I've lost interest, so closes propagate
+		rows := this.sync.Db.MultiQuery(sql, this.friendId, RTBasis)
 		data := []dataMesg{}
 		orm := make(map[string]int)
 		for rows.Next() {
 			var m dataMesg
 			var tmp []byte
 			this.sync.Db.Scan(rows, &m.Topic, &m.Seqno, &m.Key, &m.Value,
-				&m.RecordType, &tmp, &m.Priority, &m.Signature)
+				&m.RecordType, &tmp, &m.Priority, &m.Signature, &m.Clock)
 			m.Author = string(tmp)
 			orm[m.Topic] = m.Seqno
 			data = append(data, m)
@@ -165,12 +170,18 @@ func (this *clientLooper) stop() {
 	this.goRoutines.Wait()
 }
 
+// Called when a friend subscribes to a topic, or unsubscribes if enable is false
+type SubscribeListenerFunc func(id int, fingerprint *crypto.Digest, topic string, enable bool)
+
 // The SyncMgr is the primary interface for the Sync Layer
 type SyncMgr struct {
 	*link.LinkMgr
-	sinks   map[int]func(int, *crypto.Digest, *Record)
-	clients map[string]*clientLooper
-	cmut    base.RWLocker
+	sinks        map[int]func(int, *crypto.Digest, *Record)
+	clients      map[string]*clientLooper
+	cmut         base.RWLocker
+	subListeners []SubscribeListenerFunc
+	clockLock    sync.Mutex
+	lastClock    int64 // The latest clock given out or heard of
 }
 
 // Constructs a new SyncMgr, does not start it.
@@ -181,7 +192,11 @@ func NewSyncMgr(thelink *link.LinkMgr) *SyncMgr {
 		clients: make(map[string]*clientLooper),
 		cmut:    base.NewNoisyLocker(thelink.Log.Prefix() + "sync "),
 	}
+	// Clocks stored before they were checked may be too far ahead, don't follow them
+	row := mgr.Db.SingleQuery("SELECT IFNULL(MAX(clock), 0) FROM Object WHERE clock <= ?", maxClock())
+	mgr.Db.Scan(row, &mgr.lastClock)
 	mgr.AddHandler(link.ServiceNotify, mgr.onNotify)
+	mgr.AddHandler(link.ServiceOldNotify, mgr.onOldNotify)
 	mgr.SetSink(RTSubscribe, mgr.onSubscribe)
 	mgr.AddListener(mgr.onFriendChange)
 	return mgr
@@ -203,6 +218,12 @@ func (this *SyncMgr) Stop() {
 	this.LinkMgr.Stop()
 }
 
+// Older peers notify on the old service, with records we can't check, so just say why they
+// get nothing back
+func (this *SyncMgr) onOldNotify(remote int, fp *crypto.Digest, in io.Reader, out io.Writer) error {
+	return fmt.Errorf("Friend %s is too old to sync with, it needs upgrading", fp)
+}
+
 func (this *SyncMgr) onNotify(remote int, fp *crypto.Digest, in io.Reader, out io.Writer) error {
 	var mesgs []dataMesg
 	err := transfer.Decode(in, &mesgs)
@@ -232,7 +253,12 @@ func (this *SyncMgr) onNotify(remote int, fp *crypto.Digest, in io.Reader, out i
 		if !ok || prev_seq >= mesg.Seqno {
 			continue
 		}
-		sink(cl.friendId, fp, &mesg.Record)
+		// A record from too far ahead would win over every write after it, drop it
+		if this.observeClock(mesg.Clock) {
+			sink(cl.friendId, fp, &mesg.Record)
+		} else {
+			this.Log.Printf("Clock of key = %s is too far ahead, ignoring", mesg.Key)
+		}
 		this.Db.Exec("Update TopicFriend SET heard_seqno = ? WHERE topic = ? AND friend_id = ?",
 			mesg.Seqno, mesg.Topic, remote)
 	}
@@ -315,16 +341,17 @@ func (this *SyncMgr) Put(record *Record) {
 	}
 	this.Db.Exec(`
 		REPLACE INTO Object
-			(seqno, topic, key, value, type, author, priority, signature)
+			(seqno, topic, key, value, type, author, priority, signature, clock)
 		VALUES
-			(IFNULL((SELECT MAX(seqno) FROM Object), 0)+1, ?, ?, ?, ?, ?, ?, ?)`,
+			(IFNULL((SELECT MAX(seqno) FROM Object), 0)+1, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		record.Topic,
 		record.Key,
 		record.Value,
 		record.RecordType,
 		record.Author,
 		record.Priority,
-		record.Signature)
+		record.Signature,
+		record.Clock)
 
 	for _, client := range this.clients {
 		client.wakeNotify.Broadcast()
@@ -333,20 +360,21 @@ func (this *SyncMgr) Put(record *Record) {
 	this.cmut.Unlock()
 }
 
-// Get the latest record for any author for a specific topic and key and type.
+// Get the latest record for any author for a specific topic and key and type, the one with
+// the latest clock, then the highest priority, then the highest author, as CompareVersions.
 func (this *SyncMgr) Get(recordType int, topic, key string) *Record {
 	query := `
-		SELECT topic, key, value, type, author, priority, signature
+		SELECT topic, key, value, type, author, priority, signature, clock
 		FROM Object
 		WHERE topic = ? AND key = ? AND type = ?
-		ORDER BY priority DESC 
+		ORDER BY clock DESC, priority DESC, author DESC
 		LIMIT 1`
 	row := this.Db.SingleQuery(query, topic, key, recordType)
 	var record Record
 	var tmp []byte
 	if !this.Db.MaybeScan(row,
 		&record.Topic, &record.Key, &record.Value,
-		&record.RecordType, &tmp, &record.Priority, &record.Signature) {
+		&record.RecordType, &tmp, &record.Priority, &record.Signature, &record.Clock) {
 		return nil
 	}
 	record.Author = string(tmp)
@@ -356,17 +384,17 @@ func (this *SyncMgr) Get(recordType int, topic, key string) *Record {
 // Get the latest record for a specific author, topic, key and type.
 func (this *SyncMgr) GetAuthor(recordType int, topic, key, author string) *Record {
 	query := `
-		SELECT topic, key, value, type, author, priority, signature
+		SELECT topic, key, value, type, author, priority, signature, clock
 		FROM Object
 		WHERE author = ? AND topic = ? AND key = ? AND type = ?
-		ORDER BY priority DESC 
+		ORDER BY clock DESC, priority DESC
 		LIMIT 1`
 	row := this.Db.SingleQuery(query, author, topic, key, recordType)
 	var tmp []byte
 	var record Record
 	if !this.Db.MaybeScan(row,
 		&record.Topic, &record.Key, &record.Value,
-		&record.RecordType, &tmp, &record.Priority, &record.Signature) {
+		&record.RecordType, &tmp, &record.Priority, &record.Signature, &record.Clock) {
 		return nil
 	}
 	record.Author = string(tmp)
@@ -411,6 +439,27 @@ func (this *SyncMgr) Subscribe(id *crypto.Digest, topic string, enable bool) boo
 	return true
 }
 
+// Unsubscribes from every friend I'm subscribed to a topic with
+func (this *SyncMgr) UnsubscribeAll(topic string) {
+	rows := this.Db.MultiQuery(`
+		SELECT f.fingerprint FROM Friend f, TopicFriend tf
+		WHERE f.id = tf.friend_id AND tf.topic = ? AND tf.desired = 1`, topic)
+	fps := []*crypto.Digest{}
+	for rows.Next() {
+		var fpBytes []byte
+		this.Db.Scan(rows, &fpBytes)
+		var fp *crypto.Digest
+		err := transfer.DecodeBytes(fpBytes, &fp)
+		if err != nil {
+			panic(err)
+		}
+		fps = append(fps, fp)
+	}
+	for _, fp := range fps {
+		this.Subscribe(fp, topic, false)
+	}
+}
+
 func (this *SyncMgr) onSubscribe(id int, fp *crypto.Digest, rec *Record) {
 	this.cmut.RLock()
 	client, ok := this.clients[fp.String()]
@@ -427,4 +476,12 @@ func (this *SyncMgr) onSubscribe(id int, fp *crypto.Digest, rec *Record) {
 		enable, rec.Priority, id, rec.Key)
 	client.wakeNotify.Broadcast()
 	client.lock.Unlock()
+	for _, onListener := range this.subListeners {
+		onListener(id, fp, rec.Key, enable)
+	}
+}
+
+// Add a listener to get subscription requests from friends
+func (this *SyncMgr) AddSubscribeListener(listener SubscribeListenerFunc) {
+	this.subListeners = append(this.subListeners, listener)
 }
@@ -131,3 +131,55 @@ func (this *TestSyncSuite) TestSync(c *C) {
 	bob.log.Printf("Stopping Bob")
 	bob.Stop()
 }
+
+func (this *TestSyncSuite) TestClock(c *C) {
+	this.C = c
+
+	alice := this.NewTestNode("Alice", 10001)
+
+	// Clocks always move on
+	first := alice.sync.Now()
+	c.Assert(alice.sync.Now() > first, Equals, true)
+
+	// Clocks heard of are followed, unless too far ahead
+	ahead := physicalClock(time.Now().Add(time.Minute))
+	c.Assert(alice.sync.observeClock(ahead), Equals, true)
+	c.Assert(alice.sync.Now() > ahead, Equals, true)
+	c.Assert(alice.sync.observeClock(physicalClock(time.Now().Add(2*MaxClockDrift))), Equals, false)
+	c.Assert(alice.sync.Now() < maxClock(), Equals, true)
+
+	put := func(author string, priority int, clock int64) {
+		alice.sync.Put(&Record{
+			RecordType: RTData,
+			Topic:      "CuteKittens",
+			Key:        "key",
+			Value:      []byte(author),
+			Priority:   priority,
+			Author:     author,
+			Clock:      clock,
+		})
+	}
+	get := func() string {
+		return alice.sync.Get(RTData, "CuteKittens", "key").Author
+	}
+
+	// Records from before clocks go by priority
+	put("a", 2, 0)
+	put("b", 1, 0)
+	c.Assert(get(), Equals, "a")
+
+	// A clock beats any priority
+	clock := alice.sync.Now()
+	put("c", 0, clock)
+	c.Assert(get(), Equals, "c")
+
+	// The same clock goes by priority, then by author
+	put("b", 1, clock)
+	c.Assert(get(), Equals, "b")
+	put("d", 1, clock)
+	c.Assert(get(), Equals, "d")
+	c.Assert(CompareVersions(alice.sync.GetAuthor(RTData, "CuteKittens", "key", "d"),
+		alice.sync.GetAuthor(RTData, "CuteKittens", "key", "b")), Equals, 1)
+
+	alice.Stop()
+}
@@ -15,11 +15,32 @@ module App {
 	var app = angular.module('App', ['ngResource', 'angularFileUpload'])
 
 		// configuration
-		.config(['$routeProvider',
+		.config(['$routeProvider', '$httpProvider',
 			function(
-				$routeProvider: ng.IRouteProvider
+				$routeProvider: ng.IRouteProvider,
+				$httpProvider: ng.IHttpProvider
 			) {
+			// Without a good token, every call fails, so ask for one
+			$httpProvider.responseInterceptors.push(['$q', '$location',
+				function(
+					$q: ng.IQService,
+					$location: ng.ILocationService
+				) {
+					return function(promise: ng.IPromise<any>) {
+						return promise.then(null, (response) => {
+							if (response.status == 401) {
+								$location.path('/login');
+							}
+							return $q.reject(response);
+						});
+					}
+				}
+			]);
 			$routeProvider
+				.when('/login', {
+					templateUrl: 'html/login.html',
+					controller: 'LoginCtrl'
+				})
 				.when('/', {
 					templateUrl: 'html/main.html',
 					controller: 'MainCtrl'
@@ -44,6 +65,7 @@ module App {
 		}])
 
 		// controllers
+		.controller('LoginCtrl', LoginCtrl.prototype.injection())
 		.controller('MainCtrl', MainCtrl.prototype.injection())
 		.controller('CollectionListCtrl', CollectionListCtrl.prototype.injection())
 		.controller('CollectionDetailCtrl', CollectionDetailCtrl.prototype.injection())
@@ -54,6 +76,7 @@ module App {
 		.service('AppService', AppService.prototype.injection())
 
 		// resources
+		.factory('LoginResource', LoginResource())
 		.factory('SelfResource', SelfResource())
 		.factory('ProfileResource', ProfileResource())
 		.factory('CollectionResource', CollectionResource())
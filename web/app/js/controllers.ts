@@ -3,6 +3,47 @@
 module App {
 	'use strict';
 
+	export interface ILoginScope extends ng.IScope {
+		token: string;
+		loginStatus: string;
+		loginError: string;
+		onLogin: Function;
+	}
+
+	export class LoginCtrl {
+		public injection(): any[] {
+			return [
+				'$scope',
+				'$location',
+				'AppService',
+				'LoginResource',
+				LoginCtrl
+			]
+		}
+
+		constructor(
+			private $scope: ILoginScope,
+			private $location: ng.ILocationService,
+			private app: AppService,
+			private Login: IResourceClass
+		) {
+			$scope.onLogin = () => this.onLogin();
+		}
+
+		onLogin() {
+			var login = <ILogin> new this.Login();
+			login.token = this.$scope.token;
+			login.$save(() => {
+				this.$scope.token = "";
+				this.app.load();
+				this.$location.path('/');
+			}, (result) => {
+				this.$scope.loginStatus = 'has-error';
+				this.$scope.loginError = result.data;
+			});
+		}
+	}
+
 	export interface IMainScope extends IRootScope {
 		profile: IPublicProfile;
 		saveProfile: Function;
@@ -115,7 +156,7 @@ module App {
 			$scope.cid = $routeParams.cid;
 			$scope.collection = Collection.get({cid: $scope.cid});
 			$scope.writers = CollectionWriter.query({cid: $scope.cid});
-			$scope.data = CollectionData.query({cid: $scope.cid});
+			$scope.data = CollectionData.get({cid: $scope.cid});
 		}
 	}
 
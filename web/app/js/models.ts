@@ -39,6 +39,10 @@ module App {
 		pubkey: string;
 	}
 
+	export interface ILogin extends ng.resource.IResource {
+		token: string;
+	}
+
 	export interface ICollectionInvite extends ng.resource.IResource {
 		cid: string;
 		friend: string;
@@ -7,6 +7,18 @@ module App {
 		new (): ng.resource.IResource;
 	}
 
+	// Logging in sets a cookie with the token, which the browser sends with every
+	// call after, from the other resources and from links and images alike
+	export function LoginResource(): any[] {
+		return [ '$resource',
+			function(
+				$resource: ng.resource.IResourceService
+			): ng.resource.IResourceClass {
+				return $resource('/api/login');
+			}
+		]
+	}
+
 	export function SelfResource(): any[] {
 		return [ '$resource',
 			function(